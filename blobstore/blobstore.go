@@ -0,0 +1,87 @@
+// Package blobstore keeps the content of resources by its SHA256 hash for the master and the workers.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+)
+
+const ChunkSize = 4 * 1024 * 1024 // bytes
+
+var ErrBlobNotFound = errors.New("blob does not exist")
+
+// BlobStore keeps the content of resources by its SHA256 hash.
+// The reference counts of blobs are not kept in it but in resource:<hash>:counter of Redis.
+type BlobStore interface {
+	// Stat returns the size of the blob, and false if it is not stored.
+	Stat(hash string) (int64, bool, error)
+	// Open returns the content and the size of the blob, or ErrBlobNotFound.
+	// The reader also implements io.Seeker if the store supports random access.
+	Open(hash string) (io.ReadCloser, int64, error)
+	// Put stores size bytes read from reader as the blob of the hash.
+	Put(hash string, reader io.Reader, size int64) error
+	// Delete removes the blob. It is not an error if the blob does not exist.
+	Delete(hash string) error
+}
+
+// IsValidHash checks that the hash is a hex-encoded SHA256, since stores use it as a key or a path.
+func IsValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// New creates the store from its URL; "" or "redis" for the Redis of francine,
+// file:///path/to/dir for a local directory, e.g. shared by local workers, or
+// s3://access:secret@host:port/bucket[/prefix]?region=us-east-1&insecure=1 for S3-compatible storage such as MinIO.
+func New(spec string, redisPool *redis.Pool) (BlobStore, error) {
+	if spec == "" || spec == "redis" {
+		return &RedisBlobStore{redisPool}, nil
+	}
+
+	storeUrl, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch storeUrl.Scheme {
+	case "file":
+		if storeUrl.Path == "" {
+			return nil, errors.New("directory of the blob store is empty")
+		}
+		if err := os.MkdirAll(storeUrl.Path, 0755); err != nil {
+			return nil, err
+		}
+		return &FileBlobStore{storeUrl.Path}, nil
+
+	case "s3":
+		// not returned directly, since a nil *S3BlobStore is not a nil BlobStore
+		store, err := newS3BlobStore(storeUrl)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+
+	default:
+		return nil, errors.New("unknown blob store " + spec)
+	}
+}
+
+// ReadAll returns the whole content of the blob.
+func ReadAll(store BlobStore, hash string) ([]byte, error) {
+	reader, _, err := store.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,149 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// testData returns size bytes which differ between chunks.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/ChunkSize)
+	}
+	return data
+}
+
+// testRoundTrip puts the data and checks every method of the store on it.
+func testRoundTrip(t *testing.T, store BlobStore, data []byte) {
+	hash := hashOf(data)
+
+	if _, exists, err := store.Stat(hash); err != nil || exists {
+		t.Fatalf("Stat before Put: exists %v, err %v", exists, err)
+	}
+	if _, _, err := store.Open(hash); err != ErrBlobNotFound {
+		t.Fatalf("Open before Put: err %v, want ErrBlobNotFound", err)
+	}
+
+	if err := store.Put(hash, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	size, exists, err := store.Stat(hash)
+	if err != nil || !exists || size != int64(len(data)) {
+		t.Fatalf("Stat: size %d, exists %v, err %v; want %d", size, exists, err, len(data))
+	}
+
+	reader, size, err := store.Open(hash)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	read, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if size != int64(len(data)) || !bytes.Equal(read, data) {
+		t.Fatalf("Open: %d bytes of size %d differ from the %d bytes put", len(read), size, len(data))
+	}
+
+	if err := store.Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, exists, err := store.Stat(hash); err != nil || exists {
+		t.Fatalf("Stat after Delete: exists %v, err %v", exists, err)
+	}
+	if err := store.Delete(hash); err != nil {
+		t.Fatalf("Delete of a deleted blob: %v", err)
+	}
+}
+
+func TestIsValidHash(t *testing.T) {
+	tests := []struct {
+		hash  string
+		valid bool
+	}{
+		{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", true},
+		{"E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855", true},
+		{"", false},
+		{"e3b0c442", false},
+		{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b85", false},
+		{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b8555", false},
+		{"g3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", false},
+		{"../../../../../../../../../../../../../../../../../../etc/passwd", false},
+		{strings.Repeat("/", 64), false},
+	}
+
+	for _, test := range tests {
+		if valid := IsValidHash(test.hash); valid != test.valid {
+			t.Errorf("IsValidHash(%q) = %v, want %v", test.hash, valid, test.valid)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		spec  string
+		store string // type name; "" for an error
+	}{
+		{"", "redis"},
+		{"redis", "redis"},
+		{"file://" + dir + "/blobs", "file"},
+		{"file://", ""},
+		{"s3://access:secret@localhost:9000/bucket/prefix?region=ap-northeast-1&insecure=1", "s3"},
+		{"s3://localhost:9000", ""},
+		{"s3:///bucket", ""},
+		{"ftp://localhost/blobs", ""},
+	}
+
+	for _, test := range tests {
+		store, err := New(test.spec, nil)
+
+		name := ""
+		switch store.(type) {
+		case *RedisBlobStore:
+			name = "redis"
+		case *FileBlobStore:
+			name = "file"
+		case *S3BlobStore:
+			name = "s3"
+		}
+
+		if name != test.store || (err == nil) != (test.store != "") {
+			t.Errorf("New(%q) = %T, %v; want %q", test.spec, store, err, test.store)
+		}
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	store := newFakeRedisBlobStore()
+	data := []byte("teapot")
+
+	if _, err := ReadAll(store, hashOf(data)); err != ErrBlobNotFound {
+		t.Fatalf("ReadAll before Put: err %v, want ErrBlobNotFound", err)
+	}
+
+	if err := store.Put(hashOf(data), bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadAll(store, hashOf(data))
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("ReadAll = %q, %v; want %q", read, err, data)
+	}
+}
@@ -0,0 +1,102 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileBlobStore keeps a blob as a file <dir>/<first two digits of hash>/<hash>.
+type FileBlobStore struct {
+	dir string
+}
+
+func (store *FileBlobStore) path(hash string) (string, error) {
+	if !IsValidHash(hash) {
+		return "", errors.New("invalid hash " + hash)
+	}
+	return filepath.Join(store.dir, hash[:2], hash), nil
+}
+
+func (store *FileBlobStore) Stat(hash string) (int64, bool, error) {
+	path, err := store.path(hash)
+	if err != nil {
+		return 0, false, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return info.Size(), true, nil
+}
+
+func (store *FileBlobStore) Open(hash string) (io.ReadCloser, int64, error) {
+	path, err := store.path(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+func (store *FileBlobStore) Put(hash string, reader io.Reader, size int64) error {
+	path, err := store.path(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// written to a temporary file and renamed, so that readers never see a partial blob
+	file, err := ioutil.TempFile(filepath.Dir(path), hash+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(file, reader, size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (store *FileBlobStore) Delete(hash string) error {
+	path, err := store.path(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package blobstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileBlobStore{dir}
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 10},
+		{"chunk", ChunkSize},
+		{"larger than a chunk", ChunkSize + 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := testData(test.size)
+			testRoundTrip(t, store, data)
+		})
+	}
+}
+
+func TestFileBlobStoreLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileBlobStore{dir}
+	data := []byte("teapot")
+	hash := hashOf(data)
+
+	if err := store.Put(hash, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// no temporary file is left beside the blob
+	files, err := ioutil.ReadDir(filepath.Join(dir, hash[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != hash {
+		t.Fatalf("files in %s: %v, want only %s", hash[:2], files, hash)
+	}
+}
+
+func TestFileBlobStoreShortReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileBlobStore{dir}
+	data := []byte("teapot")
+	hash := hashOf(data)
+
+	// a truncated upload must not leave a partial blob
+	if err := store.Put(hash, bytes.NewReader(data[:3]), int64(len(data))); err == nil {
+		t.Fatal("Put of a short reader succeeded")
+	}
+	if _, exists, err := store.Stat(hash); err != nil || exists {
+		t.Fatalf("Stat after a failed Put: exists %v, err %v", exists, err)
+	}
+}
+
+func TestFileBlobStoreInvalidHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileBlobStore{dir}
+	hash := "../" + hashOf(nil)[3:]
+
+	if _, _, err := store.Stat(hash); err == nil {
+		t.Error("Stat of an invalid hash succeeded")
+	}
+	if _, _, err := store.Open(hash); err == nil {
+		t.Error("Open of an invalid hash succeeded")
+	}
+	if err := store.Put(hash, bytes.NewReader(nil), 0); err == nil {
+		t.Error("Put of an invalid hash succeeded")
+	}
+	if err := store.Delete(hash); err == nil {
+		t.Error("Delete of an invalid hash succeeded")
+	}
+}
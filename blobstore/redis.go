@@ -0,0 +1,180 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// RedisBlobStore keeps a blob as a string in resource:<hash>, or if it is larger than ChunkSize,
+// as a list of chunks in resource:<hash>:chunks with the total size in resource:<hash>:size.
+type RedisBlobStore struct {
+	redisPool *redis.Pool
+}
+
+func (store *RedisBlobStore) Stat(hash string) (int64, bool, error) {
+	conn := store.redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("EXISTS", "resource:"+hash)
+	conn.Send("STRLEN", "resource:"+hash)
+	conn.Send("GET", "resource:"+hash+":size")
+	resp, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, false, err
+	}
+
+	if resp[0].(int64) == 1 {
+		return resp[1].(int64), true, nil
+	}
+
+	if resp[2] != nil {
+		size, err := strconv.ParseInt(string(resp[2].([]byte)), 10, 64)
+		return size, err == nil, err
+	}
+
+	return 0, false, nil
+}
+
+type bytesBlob struct {
+	*bytes.Reader
+}
+
+func (blob bytesBlob) Close() error {
+	return nil
+}
+
+// chunkReader reads the chunks one by one, so that the whole blob is not loaded.
+type chunkReader struct {
+	conn   redis.Conn
+	key    string
+	chunks int
+	next   int
+	buf    []byte
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for len(reader.buf) == 0 {
+		if reader.next >= reader.chunks {
+			return 0, io.EOF
+		}
+		chunk, err := redis.Bytes(reader.conn.Do("LINDEX", reader.key, reader.next))
+		if err != nil {
+			return 0, err
+		}
+		reader.buf = chunk
+		reader.next++
+	}
+
+	n := copy(p, reader.buf)
+	reader.buf = reader.buf[n:]
+	return n, nil
+}
+
+func (reader *chunkReader) Close() error {
+	return reader.conn.Close()
+}
+
+func (store *RedisBlobStore) Open(hash string) (io.ReadCloser, int64, error) {
+	conn := store.redisPool.Get()
+
+	data, err := conn.Do("GET", "resource:"+hash)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if data != nil {
+		conn.Close()
+		return bytesBlob{bytes.NewReader(data.([]byte))}, int64(len(data.([]byte))), nil
+	}
+
+	conn.Send("MULTI")
+	conn.Send("LLEN", "resource:"+hash+":chunks")
+	conn.Send("GET", "resource:"+hash+":size")
+	resp, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	if resp[0].(int64) == 0 || resp[1] == nil {
+		conn.Close()
+		return nil, 0, ErrBlobNotFound
+	}
+
+	size, err := strconv.ParseInt(string(resp[1].([]byte)), 10, 64)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	return &chunkReader{conn: conn, key: "resource:" + hash + ":chunks", chunks: int(resp[0].(int64))}, size, nil
+}
+
+func (store *RedisBlobStore) Put(hash string, reader io.Reader, size int64) error {
+	conn := store.redisPool.Get()
+	defer conn.Close()
+
+	if size <= ChunkSize {
+		data, err := ioutil.ReadAll(io.LimitReader(reader, size))
+		if err != nil {
+			return err
+		}
+		_, err = conn.Do("SET", "resource:"+hash, data)
+		return err
+	}
+
+	// the chunks are pushed to a temporary list and renamed at last, so that a concurrent Put of the same blob is harmless
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpKey := "resource:" + hash + ":chunks:" + hex.EncodeToString(suffix)
+
+	chunk := make([]byte, ChunkSize)
+	for written := int64(0); written < size; {
+		n := ChunkSize
+		if size-written < ChunkSize {
+			n = int(size - written)
+		}
+		n, err := io.ReadFull(reader, chunk[:n])
+		if err != nil {
+			conn.Do("DEL", tmpKey)
+			return err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("RPUSH", tmpKey, chunk[:n])
+		conn.Send("EXPIRE", tmpKey, 60*60)
+		if _, err := conn.Do("EXEC"); err != nil {
+			conn.Do("DEL", tmpKey)
+			return err
+		}
+		written += int64(n)
+	}
+
+	return store.putChunks(hash, tmpKey, size, conn)
+}
+
+// putChunks makes the list of chunks in key the blob of the hash without copying them.
+func (store *RedisBlobStore) putChunks(hash, key string, size int64, conn redis.Conn) error {
+	conn.Send("MULTI")
+	conn.Send("RENAME", key, "resource:"+hash+":chunks")
+	conn.Send("PERSIST", "resource:"+hash+":chunks")
+	conn.Send("SET", "resource:"+hash+":size", size)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (store *RedisBlobStore) Delete(hash string) error {
+	conn := store.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", "resource:"+hash, "resource:"+hash+":chunks", "resource:"+hash+":size")
+	return err
+}
@@ -0,0 +1,288 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis implements the commands used by RedisBlobStore on strings and lists in memory.
+type fakeRedis struct {
+	mutex   sync.Mutex
+	strings map[string][]byte
+	lists   map[string][][]byte
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{strings: make(map[string][]byte), lists: make(map[string][][]byte)}
+}
+
+func fakeArg(arg interface{}) []byte {
+	switch arg := arg.(type) {
+	case []byte:
+		return append([]byte(nil), arg...)
+	case string:
+		return []byte(arg)
+	default:
+		return []byte(fmt.Sprint(arg))
+	}
+}
+
+func (fake *fakeRedis) do(command string, args []interface{}) (interface{}, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	key := ""
+	if len(args) > 0 {
+		key = string(fakeArg(args[0]))
+	}
+
+	switch strings.ToUpper(command) {
+	case "GET":
+		if value, ok := fake.strings[key]; ok {
+			return value, nil
+		}
+		return nil, nil
+	case "SET":
+		fake.strings[key] = fakeArg(args[1])
+		return "OK", nil
+	case "STRLEN":
+		return int64(len(fake.strings[key])), nil
+	case "EXISTS":
+		_, isString := fake.strings[key]
+		_, isList := fake.lists[key]
+		if isString || isList {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "DEL":
+		deleted := int64(0)
+		for _, arg := range args {
+			key := string(fakeArg(arg))
+			_, isString := fake.strings[key]
+			_, isList := fake.lists[key]
+			if isString || isList {
+				deleted++
+			}
+			delete(fake.strings, key)
+			delete(fake.lists, key)
+		}
+		return deleted, nil
+	case "RPUSH":
+		for _, arg := range args[1:] {
+			fake.lists[key] = append(fake.lists[key], fakeArg(arg))
+		}
+		return int64(len(fake.lists[key])), nil
+	case "LLEN":
+		return int64(len(fake.lists[key])), nil
+	case "LINDEX":
+		var index int
+		fmt.Sscan(string(fakeArg(args[1])), &index)
+		if index < 0 || index >= len(fake.lists[key]) {
+			return nil, nil
+		}
+		return fake.lists[key][index], nil
+	case "RENAME":
+		list, ok := fake.lists[key]
+		if !ok {
+			return nil, errors.New("ERR no such key")
+		}
+		delete(fake.lists, key)
+		fake.lists[string(fakeArg(args[1]))] = list
+		return "OK", nil
+	case "EXPIRE", "PERSIST":
+		return int64(1), nil
+	default:
+		return nil, errors.New("fake redis does not support " + command)
+	}
+}
+
+// fakeConn queues the commands sent after MULTI until EXEC like Redis does.
+type fakeConn struct {
+	fake   *fakeRedis
+	multi  bool
+	queued [][]interface{}
+}
+
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+func (conn *fakeConn) Err() error {
+	return nil
+}
+
+func (conn *fakeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(command) {
+	case "":
+		return nil, nil
+	case "MULTI":
+		conn.multi = true
+		return "OK", nil
+	case "DISCARD", "UNWATCH":
+		conn.multi, conn.queued = false, nil
+		return "OK", nil
+	case "EXEC":
+		replies := make([]interface{}, 0, len(conn.queued))
+		for _, queued := range conn.queued {
+			reply, err := conn.fake.do(queued[0].(string), queued[1:])
+			if err != nil {
+				reply = redis.Error(err.Error())
+			}
+			replies = append(replies, reply)
+		}
+		conn.multi, conn.queued = false, nil
+		return replies, nil
+	}
+
+	if conn.multi {
+		conn.queued = append(conn.queued, append([]interface{}{command}, args...))
+		return "QUEUED", nil
+	}
+	return conn.fake.do(command, args)
+}
+
+func (conn *fakeConn) Send(command string, args ...interface{}) error {
+	_, err := conn.Do(command, args...)
+	return err
+}
+
+func (conn *fakeConn) Flush() error {
+	return nil
+}
+
+func (conn *fakeConn) Receive() (interface{}, error) {
+	return nil, errors.New("fake redis does not support Receive")
+}
+
+func (fake *fakeRedis) pool() *redis.Pool {
+	return redis.NewPool(func() (redis.Conn, error) {
+		return &fakeConn{fake: fake}, nil
+	}, 1)
+}
+
+func newFakeRedisBlobStore() *RedisBlobStore {
+	return &RedisBlobStore{newFakeRedis().pool()}
+}
+
+func TestRedisBlobStore(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		chunks int // 0 for a single string
+	}{
+		{"empty", 0, 0},
+		{"small", 10, 0},
+		{"chunk", ChunkSize, 0},
+		{"larger than a chunk", ChunkSize + 1, 2},
+		{"several chunks", 2*ChunkSize + 3, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeRedis()
+			store := &RedisBlobStore{fake.pool()}
+			data := testData(test.size)
+			hash := hashOf(data)
+
+			if err := store.Put(hash, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+
+			_, isString := fake.strings["resource:"+hash]
+			chunks := fake.lists["resource:"+hash+":chunks"]
+			if isString != (test.chunks == 0) || len(chunks) != test.chunks {
+				t.Fatalf("stored as string %v and %d chunks; want %d chunks", isString, len(chunks), test.chunks)
+			}
+			for i, chunk := range chunks {
+				if i < len(chunks)-1 && len(chunk) != ChunkSize {
+					t.Fatalf("chunk %d has %d bytes", i, len(chunk))
+				}
+			}
+			// no temporary list is left
+			lists := 0
+			if test.chunks > 0 {
+				lists = 1
+			}
+			if len(fake.lists) != lists {
+				t.Fatalf("%d lists are stored, want %d", len(fake.lists), lists)
+			}
+
+			if err := store.Delete(hash); err != nil {
+				t.Fatal(err)
+			}
+			if len(fake.strings) != 0 || len(fake.lists) != 0 {
+				t.Fatalf("%d strings and %d lists are left after Delete", len(fake.strings), len(fake.lists))
+			}
+
+			testRoundTrip(t, store, data)
+		})
+	}
+}
+
+func TestRedisBlobStoreShortReader(t *testing.T) {
+	fake := newFakeRedis()
+	store := &RedisBlobStore{fake.pool()}
+	data := testData(ChunkSize + 10)
+	hash := hashOf(data)
+
+	if err := store.Put(hash, bytes.NewReader(data[:ChunkSize+5]), int64(len(data))); err == nil {
+		t.Fatal("Put of a short reader succeeded")
+	}
+	if len(fake.strings) != 0 || len(fake.lists) != 0 {
+		t.Fatalf("%d strings and %d lists are left after a failed Put", len(fake.strings), len(fake.lists))
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	fake := newFakeRedis()
+	chunks := [][]byte{[]byte("tea"), []byte(""), []byte("pot"), []byte("!")}
+	for _, chunk := range chunks {
+		fake.do("RPUSH", []interface{}{"chunks", chunk})
+	}
+
+	tests := []struct {
+		name   string
+		chunks int
+		buffer int
+		want   string
+	}{
+		{"all chunks", 4, 64, "teapot!"},
+		{"one byte at a time", 4, 1, "teapot!"},
+		{"buffer across chunks", 4, 2, "teapot!"},
+		{"first chunks", 2, 64, "tea"},
+		{"no chunks", 0, 64, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := &chunkReader{conn: &fakeConn{fake: fake}, key: "chunks", chunks: test.chunks}
+			defer reader.Close()
+
+			var read bytes.Buffer
+			if _, err := io.CopyBuffer(&read, struct{ io.Reader }{reader}, make([]byte, test.buffer)); err != nil {
+				t.Fatal(err)
+			}
+			if read.String() != test.want {
+				t.Fatalf("read %q, want %q", read.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestChunkReaderMissingChunk(t *testing.T) {
+	fake := newFakeRedis()
+	fake.do("RPUSH", []interface{}{"chunks", "tea"})
+
+	// the list is shorter than the size read on Open, e.g. deleted meanwhile
+	reader := &chunkReader{conn: &fakeConn{fake: fake}, key: "chunks", chunks: 2}
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Fatal("read of a missing chunk succeeded")
+	}
+}
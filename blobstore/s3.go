@@ -0,0 +1,357 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// blobs larger than this are uploaded in parts, since a single PUT of S3 is limited to 5 GB
+	s3MultipartThreshold = 64 * 1024 * 1024
+	// S3 allows 10000 parts, so blobs up to 640 GB can be stored
+	s3PartSize = 64 * 1024 * 1024
+	s3MaxParts = 10000
+)
+
+// newS3Client returns the client for S3. It has no timeout of the whole request, which would fail large blobs,
+// but one of each step, so that a storage which stops responding does not hang the master or workers.
+func newS3Client() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second}}
+}
+
+// S3BlobStore keeps a blob as an object <prefix><hash> of a bucket of S3-compatible storage.
+// Requests are signed by AWS Signature Version 4 with path-style URLs.
+type S3BlobStore struct {
+	endpoint  string // scheme://host[:port]
+	host      string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+
+	multipartThreshold int64
+	partSize           int64
+}
+
+func newS3BlobStore(storeUrl *url.URL) (*S3BlobStore, error) {
+	split := strings.SplitN(strings.TrimPrefix(storeUrl.Path, "/"), "/", 2)
+	if storeUrl.Host == "" || split[0] == "" {
+		return nil, errors.New("host and bucket of the blob store must not be empty")
+	}
+
+	store := &S3BlobStore{
+		endpoint: "https://" + storeUrl.Host,
+		host:     storeUrl.Host,
+		bucket:   split[0],
+		region:   storeUrl.Query().Get("region"),
+		client:   newS3Client(),
+
+		multipartThreshold: s3MultipartThreshold,
+		partSize:           s3PartSize}
+
+	if len(split) == 2 && split[1] != "" {
+		store.prefix = strings.TrimSuffix(split[1], "/") + "/"
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if storeUrl.Query().Get("insecure") == "1" {
+		store.endpoint = "http://" + storeUrl.Host
+	}
+	if storeUrl.User != nil {
+		store.accessKey = storeUrl.User.Username()
+		store.secretKey, _ = storeUrl.User.Password()
+	}
+
+	return store, nil
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// request sends a request for the object of the hash. payloadHash is the hex SHA256 of body.
+func (store *S3BlobStore) request(method, hash string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	return store.requestQuery(method, hash, nil, body, size, payloadHash)
+}
+
+// s3QueryEscape escapes a query parameter as Signature Version 4 requires, with %20 for spaces.
+func s3QueryEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// requestQuery sends a request for the object of the hash with the query parameters, which are sorted for signing.
+func (store *S3BlobStore) requestQuery(method, hash string, query map[string]string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	if !IsValidHash(hash) {
+		return nil, errors.New("invalid hash " + hash)
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		params = append(params, s3QueryEscape(key)+"="+s3QueryEscape(query[key]))
+	}
+
+	rawUrl := store.endpoint + "/" + store.bucket + "/" + store.prefix + hash
+	if len(params) > 0 {
+		rawUrl += "?" + strings.Join(params, "&")
+	}
+
+	req, err := http.NewRequest(method, rawUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	store.sign(req, payloadHash, time.Now())
+
+	return store.client.Do(req)
+}
+
+// sign sets the headers of AWS Signature Version 4 to the request, signing the host and the x-amz-* headers.
+func (store *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, store.host, payloadHash, amzDate)))
+
+	scope := date + "/" + store.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSha256([]byte("AWS4"+store.secretKey), date)
+	key = hmacSha256(key, store.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+store.accessKey+"/"+scope+
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+signature)
+}
+
+// canonicalRequest returns the canonical request of Signature Version 4 with the signed headers of sign.
+// query must be already sorted and escaped; it is empty for the requests of objects.
+func canonicalRequest(method, path, query, host, payloadHash, amzDate string) string {
+	return method + "\n" +
+		path + "\n" +
+		query + "\n" +
+		"host:" + host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" +
+		payloadHash
+}
+
+// emptyPayloadHash is the SHA256 of the empty body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func s3Error(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return errors.New("s3 returned " + resp.Status + ": " + string(body))
+}
+
+func (store *S3BlobStore) Stat(hash string) (int64, bool, error) {
+	resp, err := store.request("HEAD", hash, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, s3Error(resp)
+	}
+}
+
+func (store *S3BlobStore) Open(hash string) (io.ReadCloser, int64, error) {
+	resp, err := store.request("GET", hash, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, ErrBlobNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, 0, s3Error(resp)
+	}
+}
+
+func (store *S3BlobStore) Put(hash string, reader io.Reader, size int64) error {
+	if size > store.multipartThreshold {
+		return store.putMultipart(hash, reader, size)
+	}
+
+	// the hash of the blob is the payload hash, so the storage also verifies the content
+	resp, err := store.request("PUT", hash, io.LimitReader(reader, size), size, hash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+func (store *S3BlobStore) Delete(hash string) error {
+	resp, err := store.request("DELETE", hash, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+
+	return nil
+}
+
+// putMultipart uploads the blob in parts of partSize. S3 verifies the hash of each part, and the hash of the whole
+// is verified here before the upload is completed; the upload is aborted on errors.
+func (store *S3BlobStore) putMultipart(hash string, reader io.Reader, size int64) error {
+	parts := (size + store.partSize - 1) / store.partSize
+	if parts > s3MaxParts {
+		return errors.New("blob of " + strconv.FormatInt(size, 10) + " bytes is larger than the limit of s3")
+	}
+
+	resp, err := store.requestQuery("POST", hash, map[string]string{"uploads": ""}, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = s3Error(resp)
+	} else if err = xml.NewDecoder(resp.Body).Decode(&initiated); err == nil && initiated.UploadId == "" {
+		err = errors.New("s3 returned no upload id")
+	}
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := store.putParts(hash, initiated.UploadId, reader, size, parts); err != nil {
+		if resp, abortErr := store.requestQuery("DELETE", hash, map[string]string{"uploadId": initiated.UploadId}, nil, 0, emptyPayloadHash); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (store *S3BlobStore) putParts(hash, uploadId string, reader io.Reader, size, parts int64) error {
+	whole := sha256.New()
+	completed := struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{}
+
+	buf := make([]byte, store.partSize)
+	for i := int64(0); i < parts; i++ {
+		partSize := store.partSize
+		if i == parts-1 {
+			partSize = size - i*store.partSize
+		}
+		part := buf[:partSize]
+		if _, err := io.ReadFull(reader, part); err != nil {
+			return err
+		}
+		whole.Write(part)
+
+		partHash := sha256.Sum256(part)
+		partNumber := strconv.FormatInt(i+1, 10)
+		resp, err := store.requestQuery("PUT", hash, map[string]string{"partNumber": partNumber, "uploadId": uploadId},
+			bytes.NewReader(part), partSize, hex.EncodeToString(partHash[:]))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		completed.Parts = append(completed.Parts, s3CompletedPart{int(i + 1), resp.Header.Get("ETag")})
+	}
+
+	if hex.EncodeToString(whole.Sum(nil)) != hash {
+		return errors.New("content of blob " + hash + " does not match the hash")
+	}
+
+	body, err := xml.Marshal(&completed)
+	if err != nil {
+		return err
+	}
+	bodyHash := sha256.Sum256(body)
+	resp, err := store.requestQuery("POST", hash, map[string]string{"uploadId": uploadId},
+		bytes.NewReader(body), int64(len(body)), hex.EncodeToString(bodyHash[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// an error may be returned in the body with 200 OK once the response has started
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || bytes.Contains(respBody, []byte("<Error>")) {
+		return errors.New("s3 returned " + resp.Status + ": " + string(respBody))
+	}
+
+	return nil
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultManifestName = "manifest.json"
+
+type ArchiveResource struct {
+	Name string
+	Hash string
+	Size int64
+}
+
+// ArchiveManifest is read from the manifest in the archive, and written by ExportSession.
+// It is compatible with package.json of rotate_demo, whose Resources have no Name and are ignored.
+type ArchiveManifest struct {
+	InputJson     string
+	RenderTimeout int               `json:",omitempty"`
+	Resources     []ArchiveResource `json:",omitempty"`
+}
+
+// maxManifestSize is the limit of the manifest, which is read into memory.
+const maxManifestSize = 1024 * 1024 // bytes
+
+var errArchiveTooLarge = errors.New("archive is too large")
+
+// Archive is an archive in the request body, kept in a file of UploadDir while it is read.
+// The file is read twice; first to check the files and compute their hashes, then to store them.
+type Archive struct {
+	file         *os.File
+	size         int64
+	format       string
+	manifestName string
+	maxSize      int64 // bytes of the files in total
+	maxEntries   int
+
+	Resources []ArchiveResource // files except the manifest, in the order in the archive
+	Manifest  *ArchiveManifest  // nil if the archive does not have it
+}
+
+// detectArchiveFormat detects "zip", "tar.gz" or "tar" from the Content-Type or the magic number of data.
+func detectArchiveFormat(contentType string, data []byte) string {
+	switch contentType {
+	case "application/zip":
+		return "zip"
+	case "application/gzip", "application/x-gzip", "application/x-compressed-tar":
+		return "tar.gz"
+	case "application/x-tar":
+		return "tar"
+	}
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06")) {
+		return "zip"
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return "tar.gz"
+	}
+
+	return "tar"
+}
+
+// cleanEntryName converts the path in the archive to a resource name.
+// Absolute paths and paths out of the archive root are rejected.
+func cleanEntryName(name string) (string, error) {
+	cleaned := path.Clean(strings.Replace(name, "\\", "/", -1))
+	if !isValidResourceName(cleaned) {
+		return "", errors.New("invalid path " + name)
+	}
+
+	return cleaned, nil
+}
+
+// walkFunc is called with the resource name, the content and the size of each regular file in the archive.
+type walkFunc func(name string, reader io.Reader, size int64) error
+
+func walkTar(reader io.Reader, maxEntries int, fn walkFunc) error {
+	tarReader := tar.NewReader(reader)
+	for entries := 0; ; entries++ {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// directories and links are also counted, since they also take time to be read
+		if entries >= maxEntries {
+			return errArchiveTooLarge
+		}
+
+		// directories, links and devices are not resources
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name, err := cleanEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(name, tarReader, header.Size); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(reader io.ReaderAt, size int64, maxEntries int, fn walkFunc) error {
+	zipReader, err := zip.NewReader(reader, size)
+	if err != nil {
+		return err
+	}
+
+	if len(zipReader.File) > maxEntries {
+		return errArchiveTooLarge
+	}
+
+	for _, file := range zipReader.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		name, err := cleanEntryName(file.Name)
+		if err != nil {
+			return err
+		}
+
+		if file.UncompressedSize64 > math.MaxInt64 {
+			return errArchiveTooLarge
+		}
+
+		reader, err := file.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(name, reader, int64(file.UncompressedSize64))
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walk calls fn for each regular file in the archive.
+func (archive *Archive) walk(fn walkFunc) error {
+	if _, err := archive.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch archive.format {
+	case "zip":
+		return walkZip(archive.file, archive.size, archive.maxEntries, fn)
+	case "tar.gz":
+		gzipReader, err := gzip.NewReader(bufio.NewReader(archive.file))
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		return walkTar(gzipReader, archive.maxEntries, fn)
+	case "tar":
+		return walkTar(bufio.NewReader(archive.file), archive.maxEntries, fn)
+	default:
+		return errors.New("unknown archive format " + archive.format)
+	}
+}
+
+// scan checks the files in the archive and computes their hashes, streaming each file.
+// The sizes in the headers are checked against the limit before reading the content, and against the content.
+func (archive *Archive) scan() error {
+	remaining := archive.maxSize
+	return archive.walk(func(name string, reader io.Reader, size int64) error {
+		if size > remaining {
+			return errArchiveTooLarge
+		}
+		remaining -= size
+
+		if name == archive.manifestName {
+			if size > maxManifestSize {
+				return errors.New("manifest is too large")
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(reader, size))
+			if err != nil {
+				return err
+			}
+			manifest := new(ArchiveManifest)
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return errors.New("manifest: " + err.Error())
+			}
+			archive.Manifest = manifest
+			return nil
+		}
+
+		// a byte more is read so that a file longer than its header is detected
+		hash := sha256.New()
+		read, err := io.Copy(hash, io.LimitReader(reader, size+1))
+		if err != nil {
+			return err
+		}
+		if read != size {
+			return errors.New("size of " + name + " differs from its header")
+		}
+
+		archive.Resources = append(archive.Resources, ArchiveResource{name, hex.EncodeToString(hash.Sum(nil)), size})
+		return nil
+	})
+}
+
+// store attaches the files in the archive to the session, streaming each file to the blob store if it is not stored yet.
+func (archive *Archive) store(session string, conn redis.Conn) error {
+	i := 0
+	return archive.walk(func(name string, reader io.Reader, size int64) error {
+		if name == archive.manifestName {
+			return nil
+		}
+
+		resource := archive.Resources[i]
+		i++
+		if resource.Name != name || resource.Size != size {
+			return errors.New("archive " + archive.file.Name() + " is modified while it is read")
+		}
+
+		_, err := referenceBlob(session, resource.Name, resource.Hash, func() error {
+			return blobStore.Put(resource.Hash, reader, size)
+		}, nil, nil, conn)
+		return err
+	})
+}
+
+// Close removes the file of the archive.
+func (archive *Archive) Close() {
+	archive.file.Close()
+	if err := os.Remove(archive.file.Name()); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	unlockUpload(filepath.Base(archive.file.Name()))
+}
+
+// readArchive saves the archive in the request body to a file of UploadDir, and checks the files in it.
+// The body and the files in it are limited to ArchiveMaxSize, and the entries to ArchiveMaxEntries.
+// It writes the error response and returns nil if the archive is invalid or too large.
+func readArchive(w http.ResponseWriter, r *http.Request) *Archive {
+	config := getConfig()
+	m, _ := url.ParseQuery(r.URL.RawQuery)
+
+	archive := &Archive{
+		format:       m.Get("format"),
+		manifestName: defaultManifestName,
+		maxSize:      int64(config.ArchiveMaxSize) * 1024 * 1024,
+		maxEntries:   config.ArchiveMaxEntries}
+
+	if m.Get("manifest") != "" {
+		archive.manifestName = m.Get("manifest")
+	}
+
+	file, err := ioutil.TempFile(config.UploadDir, "archive-")
+	if err != nil {
+		raiseHttpError(w, err)
+		return nil
+	}
+	archive.file = file
+
+	// the file is locked like uploads so that cleanupUploads does not remove it
+	lockUpload(filepath.Base(file.Name()))
+
+	archive.size, err = io.Copy(file, http.MaxBytesReader(w, r.Body, archive.maxSize))
+	if err != nil {
+		archive.Close()
+		if archive.size >= archive.maxSize {
+			writeArchiveResult(w, &ArchiveResult{Status: "ArchiveTooLarge", Log: errArchiveTooLarge.Error()})
+		} else {
+			raiseHttpError(w, err)
+		}
+		return nil
+	}
+
+	if archive.format == "" {
+		head := make([]byte, 4)
+		n, _ := file.ReadAt(head, 0)
+		archive.format = detectArchiveFormat(strings.Split(r.Header.Get("Content-Type"), ";")[0], head[:n])
+	}
+
+	// the whole archive is checked before saving anything
+	if err := archive.scan(); err != nil {
+		archive.Close()
+		if err == errArchiveTooLarge {
+			writeArchiveResult(w, &ArchiveResult{Status: "ArchiveTooLarge", Log: err.Error()})
+		} else {
+			writeArchiveResult(w, &ArchiveResult{Status: "InvalidArchive", Log: err.Error()})
+		}
+		return nil
+	}
+
+	if verbose {
+		log.Printf("[MASTER] read %s archive of %d files\n", archive.format, len(archive.Resources))
+	}
+
+	return archive
+}
+
+type ArchiveResult struct {
+	Status    string
+	SessionId string            `json:",omitempty"`
+	Resources []ArchiveResource `json:",omitempty"`
+	InputJson string            `json:",omitempty"`
+	Log       string            `json:",omitempty"`
+}
+
+func writeArchiveResult(w http.ResponseWriter, result *ArchiveResult) {
+	writeJson(w, http.StatusOK, result)
+}
+
+/**
+ * @api {post} /sessions/:sessionId/archive Upload archive
+ * @apiVersion v0
+ * @apiName UploadArchive
+ * @apiGroup Render
+ *
+ * @apiDescription Unpack a tar, tar.gz or zip archive into the resources of the session.
+ * Each regular file is saved like EditResource, with its path in the archive as the resource name.
+ * If the archive has the manifest, InputJson of the session is set from it.
+ *
+ * @apiParam {binary} Input Archive. The format is detected from Content-Type or the content.
+ * @apiParam {String} [format] "tar", "tar.gz" or "zip" to specify the format explicitly.
+ * @apiParam {String} [manifest] Path of the manifest in the archive. Defaults to manifest.json.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "SessionDoesNotExist", "InvalidArchive",
+ * or "ArchiveTooLarge" if the archive or the files in it exceed ArchiveMaxSize MB, or it has more than ArchiveMaxEntries entries.
+ * @apiSuccess {Object[]} Resources Name, Hash and Size of the saved resources.
+ * @apiSuccess {String} InputJson InputJson set from the manifest, if any.
+ * @apiSuccess {String} Log Reason of InvalidArchive or ArchiveTooLarge.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status"   : "Ok",
+ *       "Resources": [
+ *         {
+ *           "Name": "scene/teapot.mesh",
+ *           "Hash": "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *           "Size": 1024
+ *         }
+ *       ],
+ *       "InputJson": "scene/teapot_redis.json"
+ *     }
+ *
+ */
+func restUploadArchive(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	e, err := doesSessionExist(session, conn)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if e == false {
+		writeArchiveResult(w, &ArchiveResult{Status: "SessionDoesNotExist"})
+		return
+	}
+
+	archive := readArchive(w, r)
+	if archive == nil {
+		return
+	}
+	defer archive.Close()
+
+	if err := archive.store(session, conn); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	result := &ArchiveResult{Status: "Ok", Resources: archive.Resources}
+	manifest := archive.Manifest
+
+	if manifest != nil && manifest.InputJson != "" {
+		conn.Send("MULTI")
+		conn.Send("SET", "session:"+session+":input-json", manifest.InputJson)
+		conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
+		if _, err := conn.Do("EXEC"); err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		result.InputJson = manifest.InputJson
+	}
+
+	writeArchiveResult(w, result)
+}
+
+/**
+ * @api {get} /sessions/:sessionId/export Export session
+ * @apiVersion v0
+ * @apiName ExportSession
+ * @apiGroup Render
+ *
+ * @apiDescription Stream a tarball of all resources of the session under their resource names,
+ * with the manifest of InputJson, RenderTimeout and the hash of each resource.
+ * The session is recreated from it by ImportSession, even after the session is expired.
+ *
+ * @apiParam {String} [format] "tar.gz" (default) or "tar".
+ * @apiParam {String} [manifest] Path of the manifest in the archive. Defaults to manifest.json.
+ *
+ * @apiSuccess {binary} Output Archive.
+ * @apiError {String} Status "SessionDoesNotExist", "ManifestConflict" if a resource has the name of the manifest,
+ * or "BlobDoesNotExist" if the blob of a resource is missing in the blob store.
+ * @apiError {String} Log The resource of ManifestConflict or BlobDoesNotExist.
+ *
+ * @apiSuccessExample Manifest:
+ *     {
+ *       "InputJson": "scene/teapot_redis.json",
+ *       "Resources": [
+ *         {
+ *           "Name": "scene/teapot.mesh",
+ *           "Hash": "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *           "Size": 1024
+ *         }
+ *       ]
+ *     }
+ *
+ */
+func restExportSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	m, _ := url.ParseQuery(r.URL.RawQuery)
+
+	format := m.Get("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+	if format != "tar.gz" && format != "tar" {
+		raiseHttpError(w, errors.New("unknown archive format "+format))
+		return
+	}
+
+	manifestName := defaultManifestName
+	if m.Get("manifest") != "" {
+		manifestName = m.Get("manifest")
+	}
+
+	e, err := doesSessionExist(session, conn)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if e == false {
+		writeArchiveResult(w, &ArchiveResult{Status: "SessionDoesNotExist"})
+		return
+	}
+
+	conn.Send("MULTI")
+	conn.Send("GET", "session:"+session+":input-json")
+	conn.Send("GET", "session:"+session+":render-timeout")
+	conn.Send("GET", "session:"+session+":modified")
+	conn.Send("SMEMBERS", "session:"+session+":resource")
+	resp, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	var manifest ArchiveManifest
+	manifest.InputJson, _ = redis.String(resp[0], nil)
+	manifest.RenderTimeout, _ = redis.Int(resp[1], nil)
+
+	modified := time.Now()
+	if unix, err := redis.Int64(resp[2], nil); err == nil {
+		modified = time.Unix(unix, 0)
+	}
+
+	names, err := redis.Strings(resp[3], nil)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+	sort.Strings(names)
+
+	manifest.Resources = make([]ArchiveResource, 0, len(names))
+	for _, name := range names {
+		if name == manifestName {
+			writeArchiveResult(w, &ArchiveResult{Status: "ManifestConflict", Log: "resource " + name + " has the name of the manifest"})
+			return
+		}
+
+		hash, err := getResourceHash(session, name, conn)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+		// deleted after SMEMBERS
+		if hash == "" {
+			continue
+		}
+
+		// the archive would not reproduce the session without the blob, so it is checked before streaming
+		size, exists, err := blobStore.Stat(hash)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+		if !exists {
+			writeArchiveResult(w, &ArchiveResult{Status: "BlobDoesNotExist", Log: "blob " + hash + " of resource " + name + " does not exist"})
+			return
+		}
+
+		manifest.Resources = append(manifest.Resources, ArchiveResource{name, hash, size})
+	}
+
+	marshaledManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if verbose {
+		log.Printf("[MASTER] exporting session %s (%d resources)\n", session, len(manifest.Resources))
+	}
+
+	// the headers cannot be changed after streaming is started, so errors are only logged from here
+	filename := "session-" + session + "." + format
+	if format == "tar.gz" {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.WriteHeader(http.StatusOK)
+
+	var writer io.Writer = w
+	if format == "tar.gz" {
+		gzipWriter := gzip.NewWriter(w)
+		defer gzipWriter.Close()
+		writer = gzipWriter
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	defer tarWriter.Close()
+
+	header := &tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(marshaledManifest)), ModTime: modified, Typeflag: tar.TypeReg}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		log.Printf("[MASTER] failed to export session %s: %s\n", session, err.Error())
+		return
+	}
+	if _, err := tarWriter.Write(marshaledManifest); err != nil {
+		log.Printf("[MASTER] failed to export session %s: %s\n", session, err.Error())
+		return
+	}
+
+	for _, resource := range manifest.Resources {
+		header := &tar.Header{Name: resource.Name, Mode: 0644, Size: resource.Size, ModTime: modified, Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			log.Printf("[MASTER] failed to export session %s: %s\n", session, err.Error())
+			return
+		}
+		if err := exportBlob(tarWriter, resource.Hash); err != nil {
+			log.Printf("[MASTER] failed to export session %s: %s\n", session, err.Error())
+			return
+		}
+	}
+}
+
+func exportBlob(w io.Writer, hash string) error {
+	reader, _, err := blobStore.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+/**
+ * @api {post} /sessions/import Import session
+ * @apiVersion v0
+ * @apiName ImportSession
+ * @apiGroup Render
+ *
+ * @apiDescription Create a new session from an archive exported by ExportSession.
+ * Every resource listed in the manifest must be in the archive with the same hash.
+ * Archives without the manifest are imported like UploadArchive into a new session.
+ *
+ * @apiParam {binary} Input Archive. The format is detected from Content-Type or the content.
+ * @apiParam {String} [format] "tar", "tar.gz" or "zip" to specify the format explicitly.
+ * @apiParam {String} [manifest] Path of the manifest in the archive. Defaults to manifest.json.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "InvalidArchive" or "ArchiveTooLarge" if not.
+ * The archive is limited like UploadArchive.
+ * @apiSuccess {String} SessionId Session ID of the new session.
+ * @apiSuccess {Object[]} Resources Name, Hash and Size of the saved resources.
+ * @apiSuccess {String} InputJson InputJson of the new session.
+ * @apiSuccess {String} Log Reason of InvalidArchive or ArchiveTooLarge.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status"   : "Ok",
+ *       "SessionId": "12",
+ *       "Resources": [
+ *         {
+ *           "Name": "scene/teapot.mesh",
+ *           "Hash": "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *           "Size": 1024
+ *         }
+ *       ],
+ *       "InputJson": "scene/teapot_redis.json"
+ *     }
+ *
+ */
+func restImportSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	archive := readArchive(w, r)
+	if archive == nil {
+		return
+	}
+	defer archive.Close()
+
+	manifest := archive.Manifest
+	if manifest == nil {
+		manifest = new(ArchiveManifest)
+	}
+
+	// verify the archive against the manifest before creating the session
+	hashes := make(map[string]string)
+	for _, resource := range archive.Resources {
+		hashes[resource.Name] = resource.Hash
+	}
+	for _, resource := range manifest.Resources {
+		if resource.Name == "" {
+			continue
+		}
+		if hash, ok := hashes[resource.Name]; !ok || hash != resource.Hash {
+			writeArchiveResult(w, &ArchiveResult{Status: "InvalidArchive", Log: "resource " + resource.Name + " does not match the manifest"})
+			return
+		}
+	}
+
+	session, err := createSession(manifest.InputJson, manifest.RenderTimeout, conn)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if err := archive.store(session, conn); err != nil {
+		// the resources stored so far are released with the session
+		if err := deleteSession(session, conn); err != nil {
+			log.Printf("[MASTER] failed to delete session %s of a failed import: %s\n", session, err.Error())
+		}
+		raiseHttpError(w, err)
+		return
+	}
+
+	if verbose {
+		log.Printf("[MASTER] imported session %s (%d resources)\n", session, len(archive.Resources))
+	}
+
+	writeArchiveResult(w, &ArchiveResult{Status: "Ok", SessionId: session, Resources: archive.Resources, InputJson: manifest.InputJson})
+}
@@ -1,6 +1,15 @@
 #!/bin/sh
 
+cd `dirname $0`
+
+# the shared packages are copied into the build context
+rm -rf blobstore protocol
+cp -R ../blobstore blobstore
+cp -R ../protocol protocol
+
 sudo docker build -t lighttransport/lte_master .
 
+rm -rf blobstore protocol
+
 #sudo docker tag lighttransport/lte_master localhost:5000/lte_master
 #sudo docker push localhost:5000/lte_master
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Config is the master configuration.
+// It is read from the JSON file given by MASTER_CONFIG, and each field can be overridden by the environment variable in its env tag.
+// Fields tagged static are not changed by reloading on SIGHUP.
+type Config struct {
+	HttpAddr           string `env:"HTTP_ADDR" static:"true"`
+	Provider           string `env:"PROVIDER" static:"true"` // "gce", "local", or "" for gce only if ETCD_HOST is set
+	LocalWorkerCommand string `env:"LOCAL_WORKER_COMMAND" static:"true"`
+	BlobStore          string `env:"BLOB_STORE" static:"true"`        // URL of the store of resources, passed to workers
+	MasterUrl          string `env:"MASTER_URL" static:"true"`        // URL of this master for workers to fetch resources; "" to use the blob store
+	WorkerPeerAddr     string `env:"WORKER_PEER_ADDR" static:"true"`  // address where workers serve resources to each other, ":7070" on gce; "" to disable
+	WorkerCacheSize    int    `env:"WORKER_CACHE_SIZE" static:"true"` // bytes of resources cached on each worker; 0 for no limit
+	UploadDir          string `env:"UPLOAD_DIR" static:"true"`        // directory where chunked uploads are kept until completed, and archives while unpacked
+	Renderer           string `env:"RENDERER" static:"true"`          // "lte", "command" or "test" run by workers; "" for lte
+	LteFloatOutput     bool   `env:"LTE_FLOAT_OUTPUT" static:"true"`  // LTE on workers supports --float_output, which HDR formats need
+	Zone               string `env:"ZONE" static:"true"`
+	BaseMachineType    string `env:"BASE_MACHINE_TYPE"`
+	MachineType        string `env:"MACHINE_TYPE"`
+
+	SessionTimeout         int `env:"SESSION_TIMEOUT"`          // minutes
+	SessionCleanupInterval int `env:"SESSION_CLEANUP_INTERVAL"` // minutes
+	RenderExpire           int `env:"RENDER_EXPIRE"`            // minutes
+	RenderCleanupInterval  int `env:"RENDER_CLEANUP_INTERVAL"`  // minutes
+	RenderMaxAttempts      int `env:"RENDER_MAX_ATTEMPTS"`      // a sample fails after requeued this many times
+	RenderTimeout          int `env:"RENDER_TIMEOUT"`           // seconds; 0 means no limit
+
+	ArchiveMaxSize    int `env:"ARCHIVE_MAX_SIZE"`    // MB; limit of an uploaded archive, and of the files unpacked from it in total
+	ArchiveMaxEntries int `env:"ARCHIVE_MAX_ENTRIES"` // entries of an uploaded archive
+
+	InstanceListInterval   int `env:"INSTANCE_LIST_INTERVAL"`   // minutes
+	InstanceTimeout        int `env:"INSTANCE_TIMEOUT"`         // minutes
+	InstanceAdjustInterval int `env:"INSTANCE_ADJUST_INTERVAL"` // minutes
+	InstanceAdjustNum      int `env:"INSTANCE_ADJUST_NUM"`      // instances
+	InstanceMax            int `env:"INSTANCE_MAX"`
+	InstanceMin            int `env:"INSTANCE_MIN"`
+	InstanceThresholdUpper int `env:"INSTANCE_THRESHOLD_UPPER"` // ms
+	InstanceThresholdLower int `env:"INSTANCE_THRESHOLD_LOWER"` // ms
+}
+
+var (
+	configMutex   sync.RWMutex
+	currentConfig = defaultConfig()
+)
+
+func defaultConfig() Config {
+	return Config{
+		HttpAddr:           ":80",
+		Provider:           "",
+		LocalWorkerCommand: "/bin/worker",
+		UploadDir:          "/tmp/lte-uploads",
+		//Zone:             "asia-east1-a",
+		Zone:            "us-central1-a",
+		BaseMachineType: "n1-highcpu-2",
+		MachineType:     "n1-highcpu-16",
+
+		SessionTimeout:         60,
+		SessionCleanupInterval: 10,
+		RenderExpire:           30,
+		RenderCleanupInterval:  5,
+		RenderMaxAttempts:      3,
+		RenderTimeout:          0,
+
+		ArchiveMaxSize:    1024,
+		ArchiveMaxEntries: 10000,
+
+		InstanceListInterval:   2,
+		InstanceTimeout:        3,
+		InstanceAdjustInterval: 3,
+		InstanceAdjustNum:      5,
+		InstanceMax:            12,
+		InstanceMin:            1,
+		InstanceThresholdUpper: 100,
+		InstanceThresholdLower: 20}
+}
+
+func getConfig() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return currentConfig
+}
+
+// redacted returns the config without the credentials in BlobStore, e.g. the secret key of S3, to be shown to clients.
+func (config Config) redacted() Config {
+	storeUrl, err := url.Parse(config.BlobStore)
+	if err != nil {
+		config.BlobStore = "***"
+	} else if _, ok := storeUrl.User.Password(); ok {
+		// the username is escaped, so the first @ ends it
+		storeUrl.User = url.User(storeUrl.User.Username())
+		config.BlobStore = strings.Replace(storeUrl.String(), "@", ":***@", 1)
+	}
+	return config
+}
+
+// supportsFloatImage reports whether workers publish float images. The float output of LTE is used only if enabled,
+// since not every build of LTE has it, and the other renderers publish one if they can.
+func (config Config) supportsFloatImage() bool {
+	return (config.Renderer != "" && config.Renderer != "lte") || config.LteFloatOutput
+}
+
+// supportsTiles reports whether workers render tiles. LTE does not, and the other renderers render the whole frame and crop it.
+func (config Config) supportsTiles() bool {
+	return config.Renderer == "command" || config.Renderer == "test"
+}
+
+func setConfig(config Config) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	currentConfig = config
+}
+
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, err
+		}
+	}
+
+	if err := overrideConfigByEnv(&config); err != nil {
+		return config, err
+	}
+
+	if err := validateConfig(&config); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func overrideConfigByEnv(config *Config) error {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("env")
+		env := os.Getenv(name)
+		if name == "" || env == "" {
+			continue
+		}
+
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(env)
+		case reflect.Int:
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return errors.New("invalid value of " + name + ": " + env)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				return errors.New("invalid value of " + name + ": " + env)
+			}
+			field.SetBool(b)
+		}
+	}
+
+	return nil
+}
+
+func validateConfig(config *Config) error {
+	if config.HttpAddr == "" {
+		return errors.New("HttpAddr is empty")
+	}
+
+	switch config.Provider {
+	case "", "gce", "local":
+	default:
+		return errors.New("unknown provider " + config.Provider)
+	}
+
+	switch config.Renderer {
+	case "", "lte", "command", "test":
+	default:
+		return errors.New("unknown renderer " + config.Renderer)
+	}
+
+	if config.UploadDir == "" {
+		return errors.New("UploadDir is empty")
+	}
+
+	if config.Provider == "local" && config.LocalWorkerCommand == "" {
+		return errors.New("LocalWorkerCommand is empty")
+	}
+
+	if config.Zone == "" || config.BaseMachineType == "" || config.MachineType == "" {
+		return errors.New("Zone, BaseMachineType and MachineType must not be empty")
+	}
+
+	if config.SessionTimeout <= 0 || config.SessionCleanupInterval <= 0 ||
+		config.RenderExpire <= 0 || config.RenderCleanupInterval <= 0 ||
+		config.InstanceListInterval <= 0 || config.InstanceTimeout <= 0 ||
+		config.InstanceAdjustInterval <= 0 {
+		return errors.New("timeouts and intervals must be positive")
+	}
+
+	if config.RenderTimeout < 0 {
+		return errors.New("RenderTimeout must not be negative")
+	}
+
+	if config.WorkerCacheSize < 0 {
+		return errors.New("WorkerCacheSize must not be negative")
+	}
+
+	if config.ArchiveMaxSize <= 0 || config.ArchiveMaxEntries <= 0 {
+		return errors.New("ArchiveMaxSize and ArchiveMaxEntries must be positive")
+	}
+
+	if config.RenderMaxAttempts <= 0 {
+		return errors.New("RenderMaxAttempts must be positive")
+	}
+
+	if config.InstanceAdjustNum <= 0 {
+		return errors.New("InstanceAdjustNum must be positive")
+	}
+
+	if config.InstanceMin < 0 || config.InstanceMin > config.InstanceMax {
+		return errors.New("InstanceMin must be between 0 and InstanceMax")
+	}
+
+	if config.InstanceThresholdLower < 0 || config.InstanceThresholdLower > config.InstanceThresholdUpper {
+		return errors.New("InstanceThresholdLower must be between 0 and InstanceThresholdUpper")
+	}
+
+	return nil
+}
+
+// keepStaticFields copies the fields tagged static from prev to config, and returns the names of those changed.
+func keepStaticFields(config *Config, prev Config) []string {
+	var changed []string
+
+	value, prevValue := reflect.ValueOf(config).Elem(), reflect.ValueOf(prev)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Tag.Get("static") != "true" {
+			continue
+		}
+
+		if value.Field(i).Interface() != prevValue.Field(i).Interface() {
+			changed = append(changed, field.Name)
+		}
+		value.Field(i).Set(prevValue.Field(i))
+	}
+
+	return changed
+}
+
+// reloadConfigOnSignal reloads the config file on SIGHUP.
+// The static fields are kept since they are used only on startup.
+func reloadConfigOnSignal(path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for {
+		<-sig
+
+		log.Println("[MASTER] reloading config ...")
+
+		config, err := loadConfig(path)
+		if err != nil {
+			log.Printf("[MASTER] failed to reload config: %s\n", err.Error())
+			continue
+		}
+
+		if changed := keepStaticFields(&config, getConfig()); len(changed) > 0 {
+			log.Printf("[MASTER] %s require restart; ignored\n", strings.Join(changed, ", "))
+		}
+
+		setConfig(config)
+
+		log.Println("[MASTER] config reloaded")
+	}
+}
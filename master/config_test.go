@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeepStaticFields(t *testing.T) {
+	prev := defaultConfig()
+
+	config := prev
+	config.HttpAddr = ":8080"
+	config.WorkerCacheSize = 1024
+	config.LteFloatOutput = true
+	config.SessionTimeout = 5
+
+	changed := keepStaticFields(&config, prev)
+	if want := []string{"HttpAddr", "WorkerCacheSize", "LteFloatOutput"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+
+	// the static fields are kept, and the others are reloaded
+	want := prev
+	want.SessionTimeout = 5
+	if config != want {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+
+	if changed := keepStaticFields(&config, prev); changed != nil {
+		t.Errorf("changed = %v of the same config", changed)
+	}
+}
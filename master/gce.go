@@ -0,0 +1,286 @@
+package main
+
+import (
+	"code.google.com/p/goauth2/oauth"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GceProvider runs workers on Google Compute Engine instances booted from CoreOS.
+// Credentials and the worker settings are read from etcd.
+type GceProvider struct {
+	etcdHost string
+	zone     string
+	env      WorkerEnv // RedisHost is replaced with redis-server of etcd
+}
+
+func getTransportFromToken(etcdHost string) (*oauth.Transport, error) {
+	gceOAuthToken, err := getEtcdValue(etcdHost, "gce-oauth-token")
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(gceOAuthToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport oauth.Transport
+	if err = json.Unmarshal(decoded, &transport); err != nil {
+		return nil, err
+	}
+
+	return &transport, nil
+}
+
+func (provider *GceProvider) Create(instanceName, machineName string) error {
+	tokenUrl, err := getEtcdValue(provider.etcdHost, "lte-worker-url")
+	if err != nil {
+		return err
+	}
+	redisServer, err := getEtcdValue(provider.etcdHost, "redis-server")
+	if err != nil {
+		return err
+	}
+	logentriesToken, err := getEtcdValue(provider.etcdHost, "logentries-token")
+	if err != nil {
+		return err
+	}
+
+	transport, err := getTransportFromToken(provider.etcdHost)
+	if err != nil {
+		return err
+	}
+
+	var cloudConfig string
+	if r, err := ioutil.ReadFile("/tmp/cloud-config-worker.yaml"); err != nil {
+		return err
+	} else {
+		cloudConfig = string(r)
+	}
+
+	env := provider.env
+	env.RedisHost = redisServer
+
+	return createWorkerInstancesInternal(*transport, provider.zone, instanceName, machineName,
+		workerCloudConfig(cloudConfig, instanceName, tokenUrl, logentriesToken, env))
+}
+
+// workerCloudConfig fills the template of the cloud-config of a worker instance.
+// <worker_env> is replaced with the options of docker run setting the variables of the env.
+func workerCloudConfig(cloudConfig, instanceName, tokenUrl, logentriesToken string, env WorkerEnv) string {
+	var envOptions []string
+	for _, v := range env.vars(instanceName) {
+		envOptions = append(envOptions, "-e "+v)
+	}
+
+	cloudConfig = strings.Replace(cloudConfig, "<hostname>", instanceName, -1)
+	cloudConfig = strings.Replace(cloudConfig, "<lte_worker_url>", tokenUrl, -1)
+	cloudConfig = strings.Replace(cloudConfig, "<worker_env>", strings.Join(envOptions, " "), -1)
+	cloudConfig = strings.Replace(cloudConfig, "<logentries_token>", logentriesToken, -1)
+	return cloudConfig
+}
+
+const (
+	DiskCreating = iota
+	DiskFailed
+	DiskReady
+)
+
+func getDiskState(transport oauth.Transport, zone, diskName string) (int, error) {
+	resp, err := transport.Client().Get(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/` + zone + `/disks/` + diskName)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return -1, err
+	}
+
+	var disk map[string]interface{}
+	if err = json.Unmarshal(body, &disk); err != nil {
+		return -1, err
+	}
+
+	switch disk["status"].(string) {
+	case "RESTORING":
+		fallthrough
+	case "CREATING":
+		return DiskCreating, nil
+	case "FAILED":
+		return DiskFailed, nil
+	case "READY":
+		return DiskReady, nil
+	default:
+		return -1, errors.New("unknown disk state " + disk["status"].(string))
+	}
+}
+
+// createWorkerInstancesInternal creates the boot disk and the instance running the cloudConfig.
+func createWorkerInstancesInternal(transport oauth.Transport, zone, instanceName, machineName, cloudConfig string) error {
+
+	if res, err := postRequest(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/`+zone+`/disks?sourceImage=https%3A%2F%2Fwww.googleapis.com%2Fcompute%2Fv1%2Fprojects%2Fcoreos-cloud%2Fglobal%2Fimages%2Fcoreos-stable-494-5-0-v20141215`,
+		map[string]interface{}{
+			"zone":        "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone,
+			"name":        instanceName,
+			"description": ""},
+		transport.Client()); err != nil {
+		return err
+	} else {
+		log.Println(res)
+	}
+
+	{
+		i := 0
+		for i = 0; i < 10; i++ {
+			log.Println("[MASTER] waiting 30s for disk preparing...")
+			time.Sleep(30 * time.Second)
+
+			state, err := getDiskState(transport, zone, instanceName)
+			if err != nil {
+				return err
+			}
+
+			if state == DiskFailed {
+				return errors.New("failed to create disk")
+			}
+			if state == DiskReady {
+				break
+			}
+		}
+		if i >= 10 {
+			return errors.New("failed to create disk")
+		}
+	}
+
+	req := map[string]interface{}{
+		"disks": []interface{}{map[string]interface{}{
+			"type":       "PERSISTENT",
+			"boot":       true,
+			"autoDelete": true,
+			"mode":       "READ_WRITE",
+			"deviceName": instanceName,
+			"zone":       "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone,
+			"source":     "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone + "/disks/" + instanceName}},
+		"networkInterfaces": []interface{}{map[string]interface{}{
+			"network": "https://www.googleapis.com/compute/v1/projects/gcp-samples/global/networks/lte-cluster",
+			// NOTE: no accessConfigs[] = will have no external internet access
+			"accessConfigs": []interface{}{map[string]string{
+				"name": "External NAT",
+				"type": "ONE_TO_ONE_NAT"}}}},
+		"metadata": map[string]interface{}{
+			"items": []interface{}{
+				map[string]string{
+					"key":   "user-data",
+					"value": cloudConfig}}},
+		"zone":         "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone,
+		"canIpForward": "false",
+		"scheduling": map[string]interface{}{
+			"automaticRestart":  true,
+			"onHostMaintenance": "MIGRATE"},
+		"machineType": "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone + "/machineTypes/" + machineName,
+		"name":        instanceName,
+		"serviceAccounts": []interface{}{
+			map[string]interface{}{
+				"email": "default",
+				"scopes": []string{
+					"https://www.googleapis.com/auth/userinfo.email",
+					"https://www.googleapis.com/auth/compute",
+					"https://www.googleapis.com/auth/devstorage.full_control"}}}}
+
+	if res, err := postRequest(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/`+zone+`/instances`,
+		req, transport.Client()); err != nil {
+		return err
+	} else {
+		log.Println(res)
+	}
+
+	return nil
+}
+
+func (provider *GceProvider) Delete(instanceName string) error {
+	transport, err := getTransportFromToken(provider.etcdHost)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", `https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/`+provider.zone+`/instances/`+instanceName, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return nil
+}
+
+func (provider *GceProvider) List() ([]string, error) {
+	transport, err := getTransportFromToken(provider.etcdHost)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := transport.Client().Get(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/` + provider.zone + `/instances?filter=name%20eq%20%27.%2Alte-worker.%2A%27`)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var unmarshaled struct {
+		Items []struct {
+			Name string `json:"name"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(body, &unmarshaled); err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0)
+
+	for _, item := range unmarshaled.Items {
+		res = append(res, item.Name)
+	}
+
+	return res, nil
+}
+
+func (provider *GceProvider) Status(instanceName string) (string, error) {
+	transport, err := getTransportFromToken(provider.etcdHost)
+	if err != nil {
+		return "", err
+	}
+	resp, err := transport.Client().Get(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/` + provider.zone + `/instances/` + instanceName)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var instance struct {
+		Status string `json:"status"`
+	}
+	if err = json.Unmarshal(body, &instance); err != nil {
+		return "", err
+	}
+
+	if instance.Status == "" {
+		return "", errors.New("unknown instance " + instanceName)
+	}
+
+	return instance.Status, nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// imageFormats lists the names accepted by format= with their content types.
+// The first format of each content type is chosen by the Accept header.
+var imageFormats = []struct {
+	Name        string
+	ContentType string
+}{
+	{"jpeg", "image/jpeg"},
+	{"png", "image/png"},
+	{"png16", "image/png"},
+	{"exr", "image/x-exr"},
+	{"hdr", "image/vnd.radiance"},
+	{"pfm", "image/x-portable-floatmap"}}
+
+// ImageFormat is an output format with its encoder options.
+type ImageFormat struct {
+	Name    string
+	Quality int // JPEG only
+}
+
+func (format ImageFormat) contentType() string {
+	for _, f := range imageFormats {
+		if f.Name == format.Name {
+			return f.ContentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+func isHdrFormat(format ImageFormat) bool {
+	return format.Name == "exr" || format.Name == "hdr" || format.Name == "pfm"
+}
+
+// needsFloatImage reports whether the format needs float samples from workers; HDR formats need their range,
+// and the lossless ones their precision, which the JPEG samples lose.
+func needsFloatImage(format ImageFormat) bool {
+	return format.Name != "jpeg"
+}
+
+// negotiateImageFormat chooses the output format from format= or the Accept header,
+// and the JPEG quality from quality=.
+func negotiateImageFormat(r *http.Request) (ImageFormat, error) {
+	m, _ := url.ParseQuery(r.URL.RawQuery)
+
+	format := ImageFormat{Name: "jpeg", Quality: 100}
+	if m["quality"] != nil {
+		n, err := strconv.Atoi(m["quality"][0])
+		if err == nil {
+			format.Quality = imin(imax(n, 1), 100)
+		}
+	}
+
+	if name := strings.ToLower(m.Get("format")); name != "" {
+		if name == "jpg" {
+			name = "jpeg"
+		}
+		for _, f := range imageFormats {
+			if f.Name == name {
+				format.Name = name
+				return format, nil
+			}
+		}
+		return format, errors.New("unsupported format " + name)
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		for _, f := range imageFormats {
+			if mediaType == f.ContentType {
+				format.Name = f.Name
+				return format, nil
+			}
+		}
+	}
+
+	return format, nil
+}
+
+// FloatImage is an RGBA image whose channels are linear float32 values.
+type FloatImage struct {
+	Pix  []float32
+	Rect image.Rectangle
+}
+
+func newFloatImage(rect image.Rectangle) *FloatImage {
+	return &FloatImage{Pix: make([]float32, 4*rect.Dx()*rect.Dy()), Rect: rect}
+}
+
+func (img *FloatImage) offset(x, y int) int {
+	return 4 * ((y-img.Rect.Min.Y)*img.Rect.Dx() + (x - img.Rect.Min.X))
+}
+
+func srgbToLinear(v float32) float32 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return float32(math.Pow(float64((v+0.055)/1.055), 2.4))
+}
+
+func linearToSrgb(v float32) float32 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return float32(1.055*math.Pow(float64(v), 1/2.4) - 0.055)
+}
+
+func clamp(f float32) uint16 {
+	i := int32(f * 65535)
+	if i < 0 {
+		i = 0
+	}
+	if i > 65535 {
+		i = 65535
+	}
+
+	return uint16(i)
+}
+
+// floatImageFromImage converts an sRGB image such as a decoded JPEG into linear values.
+func floatImageFromImage(src image.Image) *FloatImage {
+	bounds := src.Bounds()
+	img := newFloatImage(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := src.At(x, y).RGBA()
+			i := img.offset(x, y)
+			img.Pix[i+0] = srgbToLinear(float32(r) / 65535.0)
+			img.Pix[i+1] = srgbToLinear(float32(g) / 65535.0)
+			img.Pix[i+2] = srgbToLinear(float32(b) / 65535.0)
+			img.Pix[i+3] = float32(a) / 65535.0
+		}
+	}
+
+	return img
+}
+
+// toNRGBA64 converts the image back to sRGB with clamping.
+func (img *FloatImage) toNRGBA64() *image.NRGBA64 {
+	out := image.NewNRGBA64(img.Rect)
+
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i := img.offset(x, y)
+			out.SetNRGBA64(x, y, color.NRGBA64{
+				clamp(linearToSrgb(img.Pix[i+0])),
+				clamp(linearToSrgb(img.Pix[i+1])),
+				clamp(linearToSrgb(img.Pix[i+2])),
+				clamp(img.Pix[i+3])})
+		}
+	}
+
+	return out
+}
+
+// decodePfm reads a Portable Float Map, which workers publish for float images.
+func decodePfm(data []byte) (*FloatImage, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	var magic string
+	var width, height int
+	var scale float64
+	for i, dst := range []interface{}{&magic, &width, &height, &scale} {
+		token, err := readPnmToken(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch v := dst.(type) {
+		case *string:
+			*v = token
+		case *int:
+			if *v, err = strconv.Atoi(token); err != nil || *v <= 0 {
+				return nil, errors.New("invalid pfm size")
+			}
+		case *float64:
+			if *v, err = strconv.ParseFloat(token, 64); err != nil || *v == 0 {
+				return nil, errors.New("invalid pfm scale")
+			}
+		}
+		if i == 0 && magic != "PF" && magic != "Pf" {
+			return nil, errors.New("not a pfm image")
+		}
+	}
+
+	channels := 3
+	if magic == "Pf" {
+		channels = 1
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0 {
+		order = binary.LittleEndian
+	}
+
+	raw := make([]float32, width*height*channels)
+	if err := binary.Read(reader, order, raw); err != nil {
+		return nil, err
+	}
+
+	img := newFloatImage(image.Rect(0, 0, width, height))
+
+	// scanlines are stored from bottom to top
+	for y := 0; y < height; y++ {
+		row := raw[(height-1-y)*width*channels:]
+		for x := 0; x < width; x++ {
+			i := img.offset(x, y)
+			if channels == 1 {
+				img.Pix[i+0], img.Pix[i+1], img.Pix[i+2] = row[x], row[x], row[x]
+			} else {
+				img.Pix[i+0], img.Pix[i+1], img.Pix[i+2] = row[3*x+0], row[3*x+1], row[3*x+2]
+			}
+			img.Pix[i+3] = 1
+		}
+	}
+
+	return img, nil
+}
+
+// readPnmToken reads a whitespace separated header token; the last one consumes exactly one whitespace.
+func readPnmToken(reader *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			if len(token) > 0 {
+				return string(token), nil
+			}
+			continue
+		}
+		token = append(token, c)
+	}
+}
+
+func encodePfm(w io.Writer, img *FloatImage) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	if _, err := io.WriteString(w, "PF\n"+strconv.Itoa(width)+" "+strconv.Itoa(height)+"\n-1.0\n"); err != nil {
+		return err
+	}
+
+	row := make([]float32, 3*width)
+	for y := img.Rect.Max.Y - 1; y >= img.Rect.Min.Y; y-- {
+		for x := 0; x < width; x++ {
+			i := img.offset(img.Rect.Min.X+x, y)
+			row[3*x+0], row[3*x+1], row[3*x+2] = img.Pix[i+0], img.Pix[i+1], img.Pix[i+2]
+		}
+		if err := binary.Write(w, binary.LittleEndian, row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeRadianceHdr writes a Radiance RGBE image with flat (not run-length encoded) scanlines.
+func encodeRadianceHdr(w io.Writer, img *FloatImage) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	header := "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y " + strconv.Itoa(height) + " +X " + strconv.Itoa(width) + "\n"
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+
+	row := make([]byte, 4*width)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := 0; x < width; x++ {
+			i := img.offset(img.Rect.Min.X+x, y)
+			r, g, b := float64(img.Pix[i+0]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			v := math.Max(r, math.Max(g, b))
+			if v < 1e-32 {
+				row[4*x+0], row[4*x+1], row[4*x+2], row[4*x+3] = 0, 0, 0, 0
+				continue
+			}
+			mantissa, exponent := math.Frexp(v)
+			scale := mantissa * 256 / v
+			row[4*x+0] = byte(math.Max(r, 0) * scale)
+			row[4*x+1] = byte(math.Max(g, 0) * scale)
+			row[4*x+2] = byte(math.Max(b, 0) * scale)
+			row[4*x+3] = byte(exponent + 128)
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encodeExr writes a single part scanline OpenEXR image with uncompressed 32-bit float RGBA channels.
+func encodeExr(w io.Writer, img *FloatImage) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	var header bytes.Buffer
+	le := binary.LittleEndian
+
+	attribute := func(name, typeName string, value []byte) {
+		header.WriteString(name + "\x00" + typeName + "\x00")
+		binary.Write(&header, le, int32(len(value)))
+		header.Write(value)
+	}
+
+	// channels are sorted by name; the pixel data follows the same order
+	channelNames := []string{"A", "B", "G", "R"}
+	channelIndices := []int{3, 2, 1, 0}
+
+	var chlist bytes.Buffer
+	for _, name := range channelNames {
+		chlist.WriteString(name + "\x00")
+		binary.Write(&chlist, le, int32(2)) // FLOAT
+		chlist.Write([]byte{0, 0, 0, 0})    // pLinear, reserved
+		binary.Write(&chlist, le, int32(1)) // xSampling
+		binary.Write(&chlist, le, int32(1)) // ySampling
+	}
+	chlist.WriteByte(0)
+
+	var box bytes.Buffer
+	binary.Write(&box, le, []int32{0, 0, int32(width - 1), int32(height - 1)})
+
+	var floatOne, center bytes.Buffer
+	binary.Write(&floatOne, le, float32(1))
+	binary.Write(&center, le, []float32{0, 0})
+
+	attribute("channels", "chlist", chlist.Bytes())
+	attribute("compression", "compression", []byte{0}) // NO_COMPRESSION
+	attribute("dataWindow", "box2i", box.Bytes())
+	attribute("displayWindow", "box2i", box.Bytes())
+	attribute("lineOrder", "lineOrder", []byte{0}) // INCREASING_Y
+	attribute("pixelAspectRatio", "float", floatOne.Bytes())
+	attribute("screenWindowCenter", "v2f", center.Bytes())
+	attribute("screenWindowWidth", "float", floatOne.Bytes())
+	header.WriteByte(0)
+
+	if _, err := w.Write([]byte{0x76, 0x2f, 0x31, 0x01, 2, 0, 0, 0}); err != nil {
+		return err
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	// offset table; each block holds one scanline
+	blockSize := 8 + 4*len(channelNames)*width
+	offsets := make([]uint64, height)
+	for y := 0; y < height; y++ {
+		offsets[y] = uint64(8 + header.Len() + 8*height + y*blockSize)
+	}
+	if err := binary.Write(w, le, offsets); err != nil {
+		return err
+	}
+
+	block := make([]float32, len(channelNames)*width)
+	for y := 0; y < height; y++ {
+		for c, index := range channelIndices {
+			for x := 0; x < width; x++ {
+				block[c*width+x] = img.Pix[img.offset(img.Rect.Min.X+x, img.Rect.Min.Y+y)+index]
+			}
+		}
+		if err := binary.Write(w, le, []int32{int32(y), int32(4 * len(block))}); err != nil {
+			return err
+		}
+		if err := binary.Write(w, le, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// toNRGBA converts the image back to 8-bit sRGB with rounding.
+func (img *FloatImage) toNRGBA() *image.NRGBA {
+	out := image.NewNRGBA(img.Rect)
+
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i := img.offset(x, y)
+			out.SetNRGBA(x, y, color.NRGBA{
+				uint8((uint32(clamp(linearToSrgb(img.Pix[i+0])))*255 + 32767) / 65535),
+				uint8((uint32(clamp(linearToSrgb(img.Pix[i+1])))*255 + 32767) / 65535),
+				uint8((uint32(clamp(linearToSrgb(img.Pix[i+2])))*255 + 32767) / 65535),
+				uint8((uint32(clamp(img.Pix[i+3]))*255 + 32767) / 65535)})
+		}
+	}
+
+	return out
+}
+
+func encodeImage(w io.Writer, img *FloatImage, format ImageFormat) error {
+	switch format.Name {
+	case "jpeg":
+		return jpeg.Encode(w, img.toNRGBA64(), &jpeg.Options{Quality: format.Quality})
+	case "png":
+		return png.Encode(w, img.toNRGBA())
+	case "png16":
+		return png.Encode(w, img.toNRGBA64())
+	case "exr":
+		return encodeExr(w, img)
+	case "hdr":
+		return encodeRadianceHdr(w, img)
+	case "pfm":
+		return encodePfm(w, img)
+	default:
+		return errors.New("unsupported format " + format.Name)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testImage returns an image over rect whose channels are distinct values.
+func testImage(rect image.Rectangle) *FloatImage {
+	img := newFloatImage(rect)
+	for i := range img.Pix {
+		img.Pix[i] = float32(i) * 0.25
+		if i%4 == 3 {
+			img.Pix[i] = 1
+		}
+	}
+	return img
+}
+
+func pfmData(header string, order binary.ByteOrder, values []float32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	binary.Write(&buf, order, values)
+	return buf.Bytes()
+}
+
+func TestDecodePfm(t *testing.T) {
+	// scanlines are stored from bottom to top
+	rgb := []float32{
+		7, 8, 9, 10, 11, 12, // bottom
+		1, 2, 3, 4, 5, 6} // top
+	want := &FloatImage{Rect: image.Rect(0, 0, 2, 2), Pix: []float32{
+		1, 2, 3, 1, 4, 5, 6, 1,
+		7, 8, 9, 1, 10, 11, 12, 1}}
+
+	for _, data := range [][]byte{
+		pfmData("PF\n2 2\n1.0\n", binary.BigEndian, rgb),
+		pfmData("PF\n2 2\n-1.0\n", binary.LittleEndian, rgb),
+		// whitespace other than newlines separates the header as well
+		pfmData("PF 2\t2\r\n-1\n", binary.LittleEndian, rgb),
+	} {
+		img, err := decodePfm(data)
+		if err != nil {
+			t.Errorf("%q: %s", data[:12], err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(img, want) {
+			t.Errorf("%q: got %v, want %v", data[:12], img, want)
+		}
+	}
+
+	gray, err := decodePfm(pfmData("Pf\n2 1\n-1.0\n", binary.LittleEndian, []float32{0.5, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float32{0.5, 0.5, 0.5, 1, 2, 2, 2, 1}; !reflect.DeepEqual(gray.Pix, want) {
+		t.Errorf("grayscale: got %v, want %v", gray.Pix, want)
+	}
+
+	for _, data := range [][]byte{
+		pfmData("P6\n2 2\n255\n", binary.BigEndian, rgb),
+		pfmData("PF\n0 2\n-1.0\n", binary.LittleEndian, rgb),
+		pfmData("PF\n2 2\n0\n", binary.LittleEndian, rgb),
+		pfmData("PF\n2 3\n-1.0\n", binary.LittleEndian, rgb),
+		[]byte("PF\n2"),
+	} {
+		if _, err := decodePfm(data); err == nil {
+			t.Errorf("%q: decoded an invalid image", data)
+		}
+	}
+}
+
+func TestEncodePfm(t *testing.T) {
+	img := testImage(image.Rect(3, 5, 6, 7))
+
+	var buf bytes.Buffer
+	if err := encodePfm(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodePfm(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the offset of the image is not stored
+	img.Rect = img.Rect.Sub(img.Rect.Min)
+	if !reflect.DeepEqual(decoded, img) {
+		t.Errorf("got %v, want %v", decoded, img)
+	}
+}
+
+// exrAttribute reads an attribute of an OpenEXR header, or returns an empty name at the end of the header.
+func exrAttribute(t *testing.T, reader *bytes.Reader) (string, string, []byte) {
+	readString := func() string {
+		var s []byte
+		for {
+			c, err := reader.ReadByte()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c == 0 {
+				return string(s)
+			}
+			s = append(s, c)
+		}
+	}
+
+	name := readString()
+	if name == "" {
+		return "", "", nil
+	}
+	typeName := readString()
+	var size int32
+	binary.Read(reader, binary.LittleEndian, &size)
+	value := make([]byte, size)
+	if _, err := reader.Read(value); err != nil {
+		t.Fatal(err)
+	}
+	return name, typeName, value
+}
+
+func TestEncodeExr(t *testing.T) {
+	img := testImage(image.Rect(10, 20, 13, 22))
+	width, height := 3, 2
+
+	var buf bytes.Buffer
+	if err := encodeExr(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	reader := bytes.NewReader(buf.Bytes())
+	le := binary.LittleEndian
+
+	var magic, version uint32
+	binary.Read(reader, le, &magic)
+	binary.Read(reader, le, &version)
+	if magic != 20000630 || version != 2 {
+		t.Fatalf("magic %d, version %d", magic, version)
+	}
+
+	attributes := make(map[string][]byte)
+	for {
+		name, typeName, value := exrAttribute(t, reader)
+		if name == "" {
+			break
+		}
+		attributes[name+":"+typeName] = value
+	}
+	for _, name := range []string{"channels:chlist", "compression:compression", "dataWindow:box2i", "displayWindow:box2i",
+		"lineOrder:lineOrder", "pixelAspectRatio:float", "screenWindowCenter:v2f", "screenWindowWidth:float"} {
+		if _, ok := attributes[name]; !ok {
+			t.Errorf("no required attribute %s", name)
+		}
+	}
+
+	var box [4]int32
+	binary.Read(bytes.NewReader(attributes["dataWindow:box2i"]), le, &box)
+	if box != [4]int32{0, 0, int32(width - 1), int32(height - 1)} {
+		t.Errorf("dataWindow = %v", box)
+	}
+	if !bytes.HasPrefix(attributes["channels:chlist"], []byte("A\x00")) {
+		t.Errorf("channels are not sorted by name: %q", attributes["channels:chlist"])
+	}
+
+	offsets := make([]uint64, height)
+	binary.Read(reader, le, offsets)
+	for y, offset := range offsets {
+		block := bytes.NewReader(buf.Bytes()[offset:])
+		var line, size int32
+		binary.Read(block, le, &line)
+		binary.Read(block, le, &size)
+		if line != int32(y) || size != int32(4*4*width) {
+			t.Errorf("block %d: line %d, size %d", y, line, size)
+			continue
+		}
+
+		// channels A, B, G, R of the scanline one after another
+		values := make([]float32, 4*width)
+		binary.Read(block, le, values)
+		for c, index := range []int{3, 2, 1, 0} {
+			for x := 0; x < width; x++ {
+				want := img.Pix[img.offset(img.Rect.Min.X+x, img.Rect.Min.Y+y)+index]
+				if got := values[c*width+x]; got != want {
+					t.Errorf("pixel %d,%d channel %d: got %f, want %f", x, y, index, got, want)
+				}
+			}
+		}
+	}
+
+	if end := offsets[height-1] + 8 + uint64(4*4*width); end != uint64(buf.Len()) {
+		t.Errorf("the image ends at %d, but %d bytes are written", end, buf.Len())
+	}
+}
+
+func TestSrgbRoundTrip(t *testing.T) {
+	for i := 0; i <= 255; i++ {
+		v := float32(i) / 255
+		if got := linearToSrgb(srgbToLinear(v)); math.Abs(float64(got-v)) > 1e-5 {
+			t.Errorf("%f: got %f", v, got)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// decodeJson keeps numbers as json.Number so that patching does not change their representation.
+func decodeJson(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// encodePatched encodes the patched value without escaping <, > and &, which json.Marshal does for HTML.
+// It returns doc as it is if the value is unchanged, so that a patch changing nothing keeps the hash of the resource
+// while the keys of objects are sorted and the whitespace is removed otherwise.
+func encodePatched(doc []byte, value interface{}) ([]byte, error) {
+	if original, err := decodeJson(doc); err == nil && jsonEqual(original, value) {
+		return doc, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// JsonPatchOperation is an operation of RFC 6902 JSON Patch.
+type JsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJsonPatch applies RFC 6902 JSON Patch to doc. Either all operations are applied or none.
+func applyJsonPatch(doc []byte, patch []byte) ([]byte, error) {
+	var operations []JsonPatchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, err
+	}
+
+	target, err := decodeJson(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, operation := range operations {
+		target, err = applyJsonPatchOperation(target, &operation)
+		if err != nil {
+			return nil, errors.New("operation " + strconv.Itoa(i) + " (" + operation.Op + " " + operation.Path + "): " + err.Error())
+		}
+	}
+
+	return encodePatched(doc, target)
+}
+
+func applyJsonPatchOperation(doc interface{}, operation *JsonPatchOperation) (interface{}, error) {
+	path, err := parseJsonPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if operation.Op == "add" || operation.Op == "replace" || operation.Op == "test" {
+		if operation.Value == nil {
+			return nil, errors.New("value is missing")
+		}
+		if value, err = decodeJson(operation.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch operation.Op {
+	case "add":
+		return setJsonValue(doc, path, value, true)
+
+	case "remove":
+		doc, _, err := removeJsonValue(doc, path)
+		return doc, err
+
+	case "replace":
+		return setJsonValue(doc, path, value, false)
+
+	case "move", "copy":
+		from, err := parseJsonPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+
+		if operation.Op == "move" {
+			if isJsonPointerPrefix(from, path) && len(from) < len(path) {
+				return nil, errors.New("cannot move a value into its child")
+			}
+			if doc, value, err = removeJsonValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = getJsonValue(doc, from); err != nil {
+				return nil, err
+			}
+			// the copy must not share maps and slices with the source
+			marshaled, _ := json.Marshal(value)
+			if value, err = decodeJson(marshaled); err != nil {
+				return nil, err
+			}
+		}
+
+		return setJsonValue(doc, path, value, true)
+
+	case "test":
+		actual, err := getJsonValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(actual, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+
+	default:
+		return nil, errors.New("unknown op")
+	}
+}
+
+// parseJsonPointer splits an RFC 6901 JSON Pointer into unescaped reference tokens.
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("invalid json pointer " + pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+
+	return tokens, nil
+}
+
+func isJsonPointerPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses an array index token; "-" is the index just after the last element.
+func arrayIndex(token string, length int) (int, error) {
+	if token == "-" {
+		return length, nil
+	}
+
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New("invalid array index " + token)
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, errors.New("invalid array index " + token)
+	}
+
+	return index, nil
+}
+
+func getJsonValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, errors.New("member " + token + " does not exist")
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			if index >= len(container) {
+				return nil, errors.New("index " + token + " is out of range")
+			}
+			doc = container[index]
+		default:
+			return nil, errors.New("cannot refer " + token + " of a non-container value")
+		}
+	}
+
+	return doc, nil
+}
+
+// setJsonValue adds (insert is true) or replaces the value at path and returns the new document.
+func setJsonValue(doc interface{}, path []string, value interface{}, insert bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token := path[0]
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			if _, ok := container[token]; !ok && !insert {
+				return nil, errors.New("member " + token + " does not exist")
+			}
+			container[token] = value
+			return container, nil
+		}
+
+		child, ok := container[token]
+		if !ok {
+			return nil, errors.New("member " + token + " does not exist")
+		}
+		child, err := setJsonValue(child, path[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+
+	case []interface{}:
+		index, err := arrayIndex(token, len(container))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(path) == 1 && insert {
+			if index > len(container) {
+				return nil, errors.New("index " + token + " is out of range")
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+
+		if index >= len(container) {
+			return nil, errors.New("index " + token + " is out of range")
+		}
+
+		if len(path) == 1 {
+			container[index] = value
+			return container, nil
+		}
+
+		child, err := setJsonValue(container[index], path[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = child
+		return container, nil
+
+	default:
+		return nil, errors.New("cannot refer " + token + " of a non-container value")
+	}
+}
+
+// removeJsonValue removes the value at path and returns the new document and the removed value.
+func removeJsonValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+
+	token := path[0]
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, nil, errors.New("member " + token + " does not exist")
+		}
+
+		if len(path) == 1 {
+			delete(container, token)
+			return container, child, nil
+		}
+
+		child, removed, err := removeJsonValue(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		container[token] = child
+		return container, removed, nil
+
+	case []interface{}:
+		index, err := arrayIndex(token, len(container))
+		if err != nil {
+			return nil, nil, err
+		}
+		if index >= len(container) {
+			return nil, nil, errors.New("index " + token + " is out of range")
+		}
+
+		if len(path) == 1 {
+			removed := container[index]
+			return append(container[:index], container[index+1:]...), removed, nil
+		}
+
+		child, removed, err := removeJsonValue(container[index], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		container[index] = child
+		return container, removed, nil
+
+	default:
+		return nil, nil, errors.New("cannot refer " + token + " of a non-container value")
+	}
+}
+
+// jsonEqual compares decoded JSON values; numbers are equal if they have the same value.
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, ok := y[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		if errX != nil || errY != nil {
+			return x == y
+		}
+		return fx == fy
+
+	default:
+		return a == b
+	}
+}
+
+// applyMergePatch applies RFC 7396 JSON Merge Patch to doc.
+func applyMergePatch(doc []byte, patch []byte) ([]byte, error) {
+	target, err := decodeJson(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	patchValue, err := decodeJson(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodePatched(doc, mergePatch(target, patchValue))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func jsonEqualBytes(t *testing.T, got, want string) bool {
+	gotDoc, err := decodeJson([]byte(got))
+	if err != nil {
+		t.Fatalf("%s: %s", got, err.Error())
+	}
+	wantDoc, err := decodeJson([]byte(want))
+	if err != nil {
+		t.Fatalf("%s: %s", want, err.Error())
+	}
+	return reflect.DeepEqual(gotDoc, wantDoc)
+}
+
+// the examples in Appendix A of RFC 6902
+func TestApplyJsonPatch(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"A.1 adding an object member",
+			`{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			`{"baz": "qux", "foo": "bar"}`},
+		{"A.2 adding an array element",
+			`{"foo": ["bar", "baz"]}`,
+			`[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			`{"foo": ["bar", "qux", "baz"]}`},
+		{"A.3 removing an object member",
+			`{"baz": "qux", "foo": "bar"}`,
+			`[{"op": "remove", "path": "/baz"}]`,
+			`{"foo": "bar"}`},
+		{"A.4 removing an array element",
+			`{"foo": ["bar", "qux", "baz"]}`,
+			`[{"op": "remove", "path": "/foo/1"}]`,
+			`{"foo": ["bar", "baz"]}`},
+		{"A.5 replacing a value",
+			`{"baz": "qux", "foo": "bar"}`,
+			`[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			`{"baz": "boo", "foo": "bar"}`},
+		{"A.6 moving a value",
+			`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		{"A.7 moving an array element",
+			`{"foo": ["all", "grass", "cows", "eat"]}`,
+			`[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			`{"foo": ["all", "cows", "eat", "grass"]}`},
+		{"A.8 testing a value: success",
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		{"A.10 adding a nested member object",
+			`{"foo": "bar"}`,
+			`[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			`{"foo": "bar", "child": {"grandchild": {}}}`},
+		{"A.11 ignoring unrecognized elements",
+			`{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			`{"foo": "bar", "baz": "qux"}`},
+		{"A.14 ~ escape ordering",
+			`{"/": 9, "~1": 10}`,
+			`[{"op": "test", "path": "/~01", "value": 10}]`,
+			`{"/": 9, "~1": 10}`},
+		{"A.16 adding an array value",
+			`{"foo": ["bar"]}`,
+			`[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			`{"foo": ["bar", ["abc", "def"]]}`},
+		{"copying a value",
+			`{"foo": {"bar": [1, 2]}}`,
+			`[{"op": "copy", "from": "/foo/bar", "path": "/baz"}, {"op": "add", "path": "/baz/-", "value": 3}]`,
+			`{"foo": {"bar": [1, 2]}, "baz": [1, 2, 3]}`},
+		{"replacing the whole document",
+			`{"foo": "bar"}`,
+			`[{"op": "replace", "path": "", "value": [1]}]`,
+			`[1]`},
+	}
+
+	for _, test := range tests {
+		got, err := applyJsonPatch([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if !jsonEqualBytes(t, string(got), test.want) {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyJsonPatchErrors(t *testing.T) {
+	tests := []struct {
+		name, doc, patch string
+	}{
+		{"A.9 testing a value: error",
+			`{"baz": "qux"}`,
+			`[{"op": "test", "path": "/baz", "value": "bar"}]`},
+		{"A.12 adding to a nonexistent target",
+			`{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz/bat", "value": "qux"}]`},
+		{"A.15 comparing strings and numbers",
+			`{"/": 9, "~1": 10}`,
+			`[{"op": "test", "path": "/~01", "value": "10"}]`},
+		{"moving a value into its child",
+			`{"foo": {"bar": {}}}`,
+			`[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`},
+		{"removing an array element out of range",
+			`{"foo": ["bar"]}`,
+			`[{"op": "remove", "path": "/foo/1"}]`},
+		{"an unknown operation",
+			`{"foo": "bar"}`,
+			`[{"op": "frobnicate", "path": "/foo"}]`},
+		// the earlier operations are not applied either
+		{"a failure after a successful operation",
+			`{"foo": "bar"}`,
+			`[{"op": "remove", "path": "/foo"}, {"op": "test", "path": "/foo", "value": "bar"}]`},
+	}
+
+	for _, test := range tests {
+		if got, err := applyJsonPatch([]byte(test.doc), []byte(test.patch)); err == nil {
+			t.Errorf("%s: got %s, want an error", test.name, got)
+		}
+	}
+}
+
+// the examples in Appendix A of RFC 7396
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		got, err := applyMergePatch([]byte(test.doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("%s patched by %s: %s", test.doc, test.patch, err.Error())
+			continue
+		}
+		if !jsonEqualBytes(t, string(got), test.want) {
+			t.Errorf("%s patched by %s: got %s, want %s", test.doc, test.patch, got, test.want)
+		}
+	}
+}
+
+func TestPatchEncoding(t *testing.T) {
+	doc := `{"z": 1, "a": "<b>&</b>"}`
+
+	// a patch changing nothing keeps the document as it is
+	tests := []struct {
+		apply func([]byte, []byte) ([]byte, error)
+		patch string
+	}{
+		{applyJsonPatch, `[]`},
+		{applyJsonPatch, `[{"op": "replace", "path": "/z", "value": 1}]`},
+		{applyMergePatch, `{}`},
+		{applyMergePatch, `{"z": 1}`},
+	}
+	for _, test := range tests {
+		got, err := test.apply([]byte(doc), []byte(test.patch))
+		if err != nil {
+			t.Errorf("%s: %s", test.patch, err.Error())
+		} else if string(got) != doc {
+			t.Errorf("%s: got %s, want the document as it is", test.patch, got)
+		}
+	}
+
+	// HTML characters are not escaped
+	got, err := applyMergePatch([]byte(doc), []byte(`{"z": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a":"<b>&</b>","z":2}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"bytes"
-	"code.google.com/p/goauth2/oauth"
-	"encoding/base64"
 	"encoding/json"
 	"github.com/garyburd/redigo/redis"
+	"github.com/lighttransport/francine/blobstore"
+	"github.com/lighttransport/francine/protocol"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -16,26 +16,20 @@ import (
 )
 
 const (
-	//zone                  = "asia-east1-a"
-	redisMaxIdle            = 5
-	verbose                 = false
-	zone                    = "us-central1-a"
-	baseMachineType         = "n1-highcpu-2"
-	machineType             = "n1-highcpu-16"
-	sessionTimeout          = 60 // minutes
-	sessionCleanupIntereval = 10 // minutes
-	instanceListInterval    = 2  // minutes
-	instanceTimeout         = 3  // minutes
-	instanceAdjustInterval  = 3  // minutes
-	instanceAdjustNum       = 5  // instances
-	instanceMax             = 12
-	instanceMin             = 1
-	instanceThresholdUpper  = 100 // ms
-	instanceThresholdLower  = 20  // ms
-	//sessionTimeout          = 1 // minutes
-	//sessionCleanupIntereval = 2 // minutes
+	redisMaxIdle    = 5
+	verbose         = false
+	renderCancelTtl = 60 // minutes
+
+	resourceDeletingTtl = 60 // seconds to wait for the blob of a released resource to be deleted
+
+	listRetryDelay = 30 * time.Second // before listing workers again when the provider fails
+
+	maxResourceNameLength = 1024
 )
 
+// blobStore is set on startup from BlobStore of the config.
+var blobStore blobstore.BlobStore
+
 func getEtcdValue(etcdHost, key string) (string, error) {
 	resp, err := http.Get("http://" + etcdHost + "/v2/keys/" + key)
 	if err != nil {
@@ -81,201 +75,21 @@ func postRequest(url string, data interface{}, client *http.Client) (string, err
 	return string(body), nil
 }
 
-func getTransportFromToken(etcdHost string) (*oauth.Transport, error) {
-	gceOAuthToken, err := getEtcdValue(etcdHost, "gce-oauth-token")
-	if err != nil {
-		return nil, err
-	}
-
-	decoded, err := base64.StdEncoding.DecodeString(gceOAuthToken)
-	if err != nil {
-		return nil, err
-	}
-
-	var transport oauth.Transport
-	if err = json.Unmarshal(decoded, &transport); err != nil {
-		return nil, err
-	}
-
-	return &transport, nil
-}
-
-func createWorkerInstances(etcdHost string, number int, currInstances int) {
-	tokenUrl, err := getEtcdValue(etcdHost, "lte-worker-url")
-	if err != nil {
-		log.Fatal(err)
-	}
-	redisServer, err := getEtcdValue(etcdHost, "redis-server")
-	if err != nil {
-		log.Fatal(err)
-	}
-	logentriesToken, err := getEtcdValue(etcdHost, "logentries-token")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	transport, err := getTransportFromToken(etcdHost)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	var cloudConfig string
-	if r, err := ioutil.ReadFile("/tmp/cloud-config-worker.yaml"); err != nil {
-		log.Fatal(err)
-	} else {
-		cloudConfig = string(r)
-	}
-
+func createWorkerInstances(provider Provider, number int, currInstances int) {
+	config := getConfig()
 	for i := 0; i < number; i++ {
 		instanceName := "lte-worker-" + strings.Replace(time.Now().Format("20060102150405.000"), ".", "", -1)
-		machineName := machineType
+		machineName := config.MachineType
 		if i == 0 && currInstances == 0 { // first worker instance
-			machineName = baseMachineType
+			machineName = config.BaseMachineType
 		}
-		go createWorkerInstancesInternal(*transport, instanceName, machineName, tokenUrl, redisServer, logentriesToken, cloudConfig)
-		time.Sleep(300 * time.Millisecond)
-	}
-}
-
-const (
-	DiskCreating = iota
-	DiskFailed
-	DiskReady
-)
-
-func getDiskState(transport oauth.Transport, diskName string) (int, error) {
-	resp, err := transport.Client().Get(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/` + zone + `/disks/` + diskName)
-	if err != nil {
-		return -1, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return -1, err
-	}
-
-	var disk map[string]interface{}
-	if err = json.Unmarshal(body, &disk); err != nil {
-		return -1, err
-	}
-
-	switch disk["status"].(string) {
-	case "RESTORING":
-		fallthrough
-	case "CREATING":
-		return DiskCreating, nil
-	case "FAILED":
-		return DiskFailed, nil
-	case "READY":
-		return DiskReady, nil
-	default:
-		log.Fatalln("[MASTER] unknown disk state " + disk["status"].(string))
-		return -1, nil
-	}
-}
-
-func createWorkerInstancesInternal(transport oauth.Transport, instanceName, machineName, tokenUrl, redisServer, logentriesToken, cloudConfig string) {
-
-	cloudConfig = strings.Replace(cloudConfig, "<hostname>", instanceName, -1)
-	cloudConfig = strings.Replace(cloudConfig, "<lte_worker_url>", tokenUrl, -1)
-	cloudConfig = strings.Replace(cloudConfig, "<redis_server>", redisServer, -1)
-	cloudConfig = strings.Replace(cloudConfig, "<logentries_token>", logentriesToken, -1)
-
-	if res, err := postRequest(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/`+zone+`/disks?sourceImage=https%3A%2F%2Fwww.googleapis.com%2Fcompute%2Fv1%2Fprojects%2Fcoreos-cloud%2Fglobal%2Fimages%2Fcoreos-stable-494-5-0-v20141215`,
-		map[string]interface{}{
-			"zone":        "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone,
-			"name":        instanceName,
-			"description": ""},
-		transport.Client()); err != nil {
-		log.Fatalln(err)
-	} else {
-		log.Println(res)
-	}
-
-	{
-		i := 0
-		for i = 0; i < 10; i++ {
-			log.Println("[MASTER] waiting 30s for disk preparing...")
-			time.Sleep(30 * time.Second)
-
-			state, err := getDiskState(transport, instanceName)
-			if err != nil {
-				log.Fatalln(err)
-			}
-
-			if state == DiskFailed {
-				log.Println("[MASTER] failed to create disk")
-				return
-			}
-			if state == DiskReady {
-				break
+		go func() {
+			if err := provider.Create(instanceName, machineName); err != nil {
+				log.Printf("[MASTER] failed to create %s: %s\n", instanceName, err.Error())
 			}
-		}
-		if i >= 10 {
-			log.Println("[MASTER] failed to create disk")
-			return
-		}
-	}
-
-	req := map[string]interface{}{
-		"disks": []interface{}{map[string]interface{}{
-			"type":       "PERSISTENT",
-			"boot":       true,
-			"autoDelete": true,
-			"mode":       "READ_WRITE",
-			"deviceName": instanceName,
-			"zone":       "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone,
-			"source":     "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone + "/disks/" + instanceName}},
-		"networkInterfaces": []interface{}{map[string]interface{}{
-			"network": "https://www.googleapis.com/compute/v1/projects/gcp-samples/global/networks/lte-cluster",
-			// NOTE: no accessConfigs[] = will have no external internet access
-			"accessConfigs": []interface{}{map[string]string{
-				"name": "External NAT",
-				"type": "ONE_TO_ONE_NAT"}}}},
-		"metadata": map[string]interface{}{
-			"items": []interface{}{
-				map[string]string{
-					"key":   "user-data",
-					"value": cloudConfig}}},
-		"zone":         "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone,
-		"canIpForward": "false",
-		"scheduling": map[string]interface{}{
-			"automaticRestart":  true,
-			"onHostMaintenance": "MIGRATE"},
-		"machineType": "https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/" + zone + "/machineTypes/" + machineName,
-		"name":        instanceName,
-		"serviceAccounts": []interface{}{
-			map[string]interface{}{
-				"email": "default",
-				"scopes": []string{
-					"https://www.googleapis.com/auth/userinfo.email",
-					"https://www.googleapis.com/auth/compute",
-					"https://www.googleapis.com/auth/devstorage.full_control"}}}}
-
-	if res, err := postRequest(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/`+zone+`/instances`,
-		req, transport.Client()); err != nil {
-		log.Fatal(err)
-	} else {
-		log.Println(res)
-	}
-}
-
-func deleteWorkerInstance(etcdHost, instanceName string) error {
-	transport, err := getTransportFromToken(etcdHost)
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequest("DELETE", `https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/`+zone+`/instances/`+instanceName, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := transport.Client().Do(req)
-	if err != nil {
-		return err
+		}()
+		time.Sleep(300 * time.Millisecond)
 	}
-	defer resp.Body.Close()
-	ioutil.ReadAll(resp.Body)
-	return nil
 }
 
 func stopWorker(workerName string, redisPool *redis.Pool) error {
@@ -290,43 +104,17 @@ func stopWorker(workerName string, redisPool *redis.Pool) error {
 	return nil
 }
 
-func listWorkerInstances(etcdHost string) ([]string, error) {
-	transport, err := getTransportFromToken(etcdHost)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := transport.Client().Get(`https://www.googleapis.com/compute/v1/projects/gcp-samples/zones/` + zone + `/instances?filter=name%20eq%20%27.%2Alte-worker.%2A%27`)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var unmarshaled struct {
-		Items []struct {
-			Name string `json:"name"`
-		} `json:"items"`
-	}
-	if err = json.Unmarshal(body, &unmarshaled); err != nil {
-		return nil, err
-	}
-
-	res := make([]string, 0)
-
-	for _, item := range unmarshaled.Items {
-		res = append(res, item.Name)
-	}
-
-	return res, nil
-}
-
 type Worker struct {
 	CreatedOn time.Time
 	PingOn    time.Time
 	Stopped   bool
+	Cache     *protocol.CacheStats // reported with the last ping; nil for old workers
+}
+
+// WorkerPing is "ping:<worker name>[:<cache stats in JSON>]" sent by a worker.
+type WorkerPing struct {
+	Name  string
+	Cache *protocol.CacheStats
 }
 
 func durMin(x, y time.Duration) time.Duration {
@@ -337,24 +125,101 @@ func durMin(x, y time.Duration) time.Duration {
 	}
 }
 
-func killZombies(etcdHost string, workers map[string]Worker) {
+func killZombies(provider Provider, workers map[string]Worker) {
 	now := time.Now()
 	log.Println("[MASTER] start zombie hunting...")
 	for name, info := range workers {
 		createdDur := now.Sub(info.CreatedOn)
 		pingDur := now.Sub(info.PingOn)
 		log.Printf("[MASTER] %s created %d min before, ping %d min before\n", name, createdDur/time.Minute, pingDur/time.Minute)
-		if durMin(createdDur, pingDur)/time.Minute > instanceTimeout {
+		if durMin(createdDur, pingDur)/time.Minute > time.Duration(getConfig().InstanceTimeout) {
 			log.Printf("[MASTER] %s is zombie; going to delete ...\n", name)
-			if err := deleteWorkerInstance(etcdHost, name); err != nil {
-				log.Fatalln(err)
+			// the other zombies are still deleted, and this one is tried again on the next hunting
+			if err := provider.Delete(name); err != nil {
+				log.Println(err)
 			}
 		}
 	}
 	log.Println("[MASTER] finished zombie hunting.")
 }
 
-func manageWorkers(etcdHost string, redisPool *redis.Pool, workerPing chan string, waitingDuration chan time.Duration, reloadWorkers chan struct{}) {
+// requeueStaleRenders requeues renders held by workers which are gone or have not sent pings for a while.
+func requeueStaleRenders(redisPool *redis.Pool, workers map[string]Worker) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	names, err := conn.Do("SMEMBERS", "render-inflight-workers")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	for _, nameBytes := range names.([]interface{}) {
+		name := string(nameBytes.([]byte))
+
+		info, alive := workers[name]
+		if alive && durMin(now.Sub(info.CreatedOn), now.Sub(info.PingOn))/time.Minute <= time.Duration(getConfig().InstanceTimeout) {
+			continue
+		}
+
+		if verbose {
+			log.Printf("[MASTER] checking in-flight renders of %s\n", name)
+		}
+
+		if err := protocol.RequeueInflightRenders("render-inflight:"+name, conn, "[MASTER]", releaseHashes(conn)); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if !alive {
+			conn.Do("SREM", "render-inflight-workers", name)
+		}
+	}
+}
+
+// trackWorkers knows workers only by their pings, and requeues renders of the stale ones, when no provider manages workers.
+// Workers which have not sent pings since the master started are considered gone after InstanceTimeout.
+func trackWorkers(redisPool *redis.Pool, workerPing chan WorkerPing, reloadWorkers chan struct{}) {
+	workers := make(map[string]Worker)
+
+	// every live worker sends a ping before the first check
+	requeue := time.After(time.Duration(getConfig().InstanceTimeout) * time.Minute)
+
+	for {
+		select {
+		case ping := <-workerPing:
+			if verbose {
+				log.Printf("[MASTER] ping from %s\n", ping.Name)
+			}
+			worker, ok := workers[ping.Name]
+			if !ok {
+				worker.CreatedOn = time.Now()
+			}
+			worker.PingOn = time.Now()
+			worker.Cache = ping.Cache
+			workers[ping.Name] = worker
+
+		case <-reloadWorkers:
+			redisConn := redisPool.Get()
+			for workerName, _ := range workers {
+				redisConn.Do("RPUSH", "cmd:"+workerName, "restart")
+			}
+			redisConn.Close()
+
+		case <-requeue:
+			snapshot := make(map[string]Worker)
+			for name, info := range workers {
+				snapshot[name] = info
+			}
+			go requeueStaleRenders(redisPool, snapshot)
+
+			requeue = time.After(time.Duration(getConfig().InstanceListInterval) * time.Minute)
+		}
+	}
+}
+
+func manageWorkers(provider Provider, redisPool *redis.Pool, workerPing chan WorkerPing, waitingDuration chan time.Duration, reloadWorkers chan struct{}) {
 	workers := make(map[string]Worker)
 
 	workerListChan := make(chan []string, 8)
@@ -363,14 +228,14 @@ func manageWorkers(etcdHost string, redisPool *redis.Pool, workerPing chan strin
 	go func() {
 		for {
 			reloadWorkerList <- struct{}{}
-			time.Sleep(instanceListInterval * time.Minute)
+			time.Sleep(time.Duration(getConfig().InstanceListInterval) * time.Minute)
 		}
 	}()
 
 	adjustInstance := make(chan struct{}, 8)
 	go func() {
 		for {
-			time.Sleep(instanceAdjustInterval * time.Minute)
+			time.Sleep(time.Duration(getConfig().InstanceAdjustInterval) * time.Minute)
 			adjustInstance <- struct{}{}
 		}
 	}()
@@ -380,14 +245,22 @@ func manageWorkers(etcdHost string, redisPool *redis.Pool, workerPing chan strin
 
 	for {
 		select {
-		case workerName := <-workerPing:
-			log.Printf("[MASTER] ping from %s\n", workerName)
-			if worker, ok := workers[workerName]; ok {
+		case ping := <-workerPing:
+			// the cache stats of every ping are too many to log unless verbose
+			if verbose && ping.Cache != nil {
+				log.Printf("[MASTER] ping from %s; cache %d/%d bytes in %d files, %d pinned, %d hits, %d misses, %d evictions\n",
+					ping.Name, ping.Cache.Bytes, ping.Cache.Limit, ping.Cache.Files, ping.Cache.Pinned,
+					ping.Cache.Hits, ping.Cache.Misses, ping.Cache.Evictions)
+			} else {
+				log.Printf("[MASTER] ping from %s\n", ping.Name)
+			}
+			if worker, ok := workers[ping.Name]; ok {
 				newWorker := worker
 				newWorker.PingOn = time.Now()
-				workers[workerName] = newWorker
+				newWorker.Cache = ping.Cache
+				workers[ping.Name] = newWorker
 			} else {
-				log.Printf("[MASTER] unknown worker %s; ignore\n", workerName)
+				log.Printf("[MASTER] unknown worker %s; ignore\n", ping.Name)
 			}
 
 		case waitingDurationVal := <-waitingDuration:
@@ -404,11 +277,16 @@ func manageWorkers(etcdHost string, redisPool *redis.Pool, workerPing chan strin
 			redisConn.Close()
 		case <-reloadWorkerList:
 			go func() {
-				lst, err := listWorkerInstances(etcdHost)
-				if err != nil {
-					log.Fatalln(err)
+				// the workers are kept as they are while the provider is unavailable
+				for {
+					lst, err := provider.List()
+					if err == nil {
+						workerListChan <- lst
+						return
+					}
+					log.Printf("[MASTER] failed to list workers: %s; retrying\n", err.Error())
+					time.Sleep(listRetryDelay)
 				}
-				workerListChan <- lst
 			}()
 		case workerList := <-workerListChan:
 			newWorkers := make(map[string]Worker)
@@ -427,30 +305,36 @@ func manageWorkers(etcdHost string, redisPool *redis.Pool, workerPing chan strin
 			if len(workers) == 0 {
 				adjustInstance <- struct{}{}
 			}
-			go killZombies(etcdHost, workers)
+			snapshot := make(map[string]Worker)
+			for name, info := range workers {
+				snapshot[name] = info
+			}
+			go killZombies(provider, snapshot)
+			go requeueStaleRenders(redisPool, snapshot)
 		case <-adjustInstance:
+			config := getConfig()
 			log.Printf("[MASTER] start automatic instance creation/deletion\n")
 			log.Printf("[MASTER] available: %d workers\n", len(workers))
 			newInstanceNum := len(workers)
 			if waitingDurDenom == 0 {
-				newInstanceNum -= instanceAdjustNum
+				newInstanceNum -= config.InstanceAdjustNum
 				log.Println("[MASTER] no waiting duration log found")
 			} else {
 				waitingDurAvr := waitingDurNumer / waitingDurDenom
 				log.Printf("[MASTER] average waiting duration: %d ms\n", waitingDurAvr/int(time.Millisecond))
-				if waitingDurAvr > int(instanceThresholdUpper*time.Millisecond) {
-					newInstanceNum += instanceAdjustNum
-				} else if waitingDurAvr < int(instanceThresholdLower*time.Millisecond) {
-					newInstanceNum -= instanceAdjustNum
+				if waitingDurAvr > config.InstanceThresholdUpper*int(time.Millisecond) {
+					newInstanceNum += config.InstanceAdjustNum
+				} else if waitingDurAvr < config.InstanceThresholdLower*int(time.Millisecond) {
+					newInstanceNum -= config.InstanceAdjustNum
 				}
 			}
-			newInstanceNum = imax(instanceMin, imin(instanceMax, newInstanceNum))
+			newInstanceNum = imax(config.InstanceMin, imin(config.InstanceMax, newInstanceNum))
 			log.Printf("[MASTER] new instance number was decided to be %d\n", newInstanceNum)
 			waitingDurDenom = 0
 			waitingDurNumer = 0
 			diff := newInstanceNum - len(workers)
 			if diff > 0 {
-				go createWorkerInstances(etcdHost, diff, len(workers))
+				go createWorkerInstances(provider, diff, len(workers))
 			} else {
 				rem := -diff
 				newWorkers := make(map[string]Worker)
@@ -477,7 +361,8 @@ func cleanupSessions(redisPool *redis.Pool) {
 	defer conn.Close()
 
 	for {
-		time.Sleep(sessionCleanupIntereval * time.Minute)
+		config := getConfig()
+		time.Sleep(time.Duration(config.SessionCleanupInterval) * time.Minute)
 		if verbose {
 			log.Println("[MASTER] clean up unused sessions ...")
 		}
@@ -505,15 +390,26 @@ func cleanupSessions(redisPool *redis.Pool) {
 				return
 			}
 			prev := time.Unix(modifiedUnix, 0)
-			if time.Now().Sub(prev) > sessionTimeout*time.Minute {
+			if time.Now().Sub(prev) > time.Duration(config.SessionTimeout)*time.Minute {
 				deleteSession(sessionString, conn)
 			}
 		}
 
+		cleanupUploads(conn)
+
 	}
 }
 
 func main() {
+	configPath := os.Getenv("MASTER_CONFIG")
+	config, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	setConfig(config)
+
+	go reloadConfigOnSignal(configPath)
+
 	etcdHost := os.Getenv("ETCD_HOST")
 
 	redisUrl := os.Getenv("REDIS_HOST")
@@ -537,12 +433,29 @@ func main() {
 		}, redisMaxIdle)
 	defer redisPool.Close()
 
-	workerPing := make(chan string, 256)
+	blobStore, err = blobstore.New(config.BlobStore, redisPool)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := os.MkdirAll(config.UploadDir, 0700); err != nil {
+		log.Fatalln(err)
+	}
+
+	workerPing := make(chan WorkerPing, 256)
 	waitingDuration := make(chan time.Duration, 256)
 	reloadWorkers := make(chan struct{}, 256)
 
-	if etcdHost != "" {
-		go manageWorkers(etcdHost, redisPool, workerPing, waitingDuration, reloadWorkers)
+	var provider Provider
+	if config.Provider != "" || etcdHost != "" {
+		provider, err = newProvider(config, etcdHost, redisUrl)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go manageWorkers(provider, redisPool, workerPing, waitingDuration, reloadWorkers)
+	} else {
+		// workers started by hand still leave renders in their in-flight lists when they die
+		go trackWorkers(redisPool, workerPing, reloadWorkers)
 	}
 
 	go startRestServer(redisPool, waitingDuration)
@@ -557,8 +470,8 @@ func main() {
 			split := strings.Split(popped, ":")
 			switch split[0] {
 			case "create":
-				if etcdHost == "" {
-					log.Println("please set ETCD_HOST")
+				if provider == nil {
+					log.Println("please set ETCD_HOST or PROVIDER")
 					os.Exit(1)
 				}
 				number := 1
@@ -569,9 +482,18 @@ func main() {
 						continue
 					}
 				}
-				go createWorkerInstances(etcdHost, number, /* fixme */0)
+				go createWorkerInstances(provider, number, /* fixme */0)
 			case "ping":
-				workerPing <- split[1]
+				ping := WorkerPing{Name: split[1]}
+				// the stats in JSON may contain colons
+				if stats := strings.SplitN(popped, ":", 3); len(stats) == 3 {
+					ping.Cache = &protocol.CacheStats{}
+					if err := json.Unmarshal([]byte(stats[2]), ping.Cache); err != nil {
+						log.Println(err)
+						ping.Cache = nil
+					}
+				}
+				workerPing <- ping
 			case "restart_workers":
 				reloadWorkers <- struct{}{}
 			}
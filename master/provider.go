@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	InstanceRunning    = "RUNNING"
+	InstanceTerminated = "TERMINATED"
+)
+
+// Provider creates, lists and deletes worker instances.
+// Every instance runs one worker whose WORKER_NAME is the instance name.
+type Provider interface {
+	// Create blocks until the instance is requested to the provider.
+	Create(instanceName, machineName string) error
+	List() ([]string, error)
+	Delete(instanceName string) error
+	Status(instanceName string) (string, error)
+}
+
+// WorkerEnv is the configuration of the master passed to every worker as its environment variables.
+type WorkerEnv struct {
+	RedisHost      string
+	BlobStore      string
+	MasterUrl      string
+	PeerAddr       string
+	CacheSize      int
+	Renderer       string
+	LteFloatOutput bool
+}
+
+func newWorkerEnv(config Config, redisUrl string) WorkerEnv {
+	return WorkerEnv{
+		RedisHost:      redisUrl,
+		BlobStore:      config.BlobStore,
+		MasterUrl:      config.MasterUrl,
+		PeerAddr:       config.WorkerPeerAddr,
+		CacheSize:      config.WorkerCacheSize,
+		Renderer:       config.Renderer,
+		LteFloatOutput: config.LteFloatOutput}
+}
+
+// vars returns the environment variables of the worker named workerName in the form of "KEY=value".
+func (env WorkerEnv) vars(workerName string) []string {
+	return []string{
+		"WORKER_NAME=" + workerName,
+		"REDIS_HOST=" + env.RedisHost,
+		"BLOB_STORE=" + env.BlobStore,
+		"MASTER_URL=" + env.MasterUrl,
+		"PEER_ADDR=" + env.PeerAddr,
+		"CACHE_SIZE=" + strconv.Itoa(env.CacheSize),
+		"RENDERER=" + env.Renderer,
+		"LTE_FLOAT_OUTPUT=" + strconv.FormatBool(env.LteFloatOutput)}
+}
+
+func newProvider(config Config, etcdHost, redisUrl string) (Provider, error) {
+	env := newWorkerEnv(config, redisUrl)
+	switch config.Provider {
+	case "", "gce":
+		if etcdHost == "" {
+			return nil, errors.New("please set ETCD_HOST for gce provider")
+		}
+		if config.Renderer != "" && config.Renderer != "lte" {
+			return nil, errors.New("gce provider runs only lte")
+		}
+		return &GceProvider{etcdHost: etcdHost, zone: config.Zone, env: env}, nil
+	case "local":
+		return newLocalProvider(config.LocalWorkerCommand, env), nil
+	default:
+		return nil, errors.New("unknown provider " + config.Provider)
+	}
+}
+
+// LocalProvider runs workers as child processes of the master on the same host.
+// The command is split by spaces and run with the variables of WorkerEnv set, so it can also be
+// a container, e.g. "docker run --rm -e WORKER_NAME -e REDIS_HOST -e BLOB_STORE -e MASTER_URL lighttransport/lte_worker /bin/worker".
+// With PEER_ADDR "127.0.0.1:0", the workers on the host distribute resources to each other on their own ports.
+type LocalProvider struct {
+	command []string
+	env     WorkerEnv
+
+	mutex     sync.Mutex
+	instances map[string]*LocalInstance
+}
+
+// localRestartDelay is the wait before restarting a failed local worker.
+var localRestartDelay = 5 * time.Second
+
+type LocalInstance struct {
+	cmd     *exec.Cmd
+	exited  bool
+	deleted bool
+}
+
+func newLocalProvider(command string, env WorkerEnv) *LocalProvider {
+	return &LocalProvider{
+		command:   strings.Fields(command),
+		env:       env,
+		instances: make(map[string]*LocalInstance)}
+}
+
+func (provider *LocalProvider) start(instanceName string, instance *LocalInstance) error {
+	cmd := exec.Command(provider.command[0], provider.command[1:]...)
+	cmd.Env = append(os.Environ(), provider.env.vars(instanceName)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	instance.cmd = cmd
+	instance.exited = false
+
+	go provider.wait(instanceName, instance, cmd)
+
+	return nil
+}
+
+// wait restarts the worker when it exits with failure like systemd does on the cloud instances.
+func (provider *LocalProvider) wait(instanceName string, instance *LocalInstance, cmd *exec.Cmd) {
+	err := cmd.Wait()
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	instance.exited = true
+
+	if err == nil || instance.deleted {
+		log.Printf("[MASTER] local worker %s exited\n", instanceName)
+		provider.forget(instanceName, instance)
+		return
+	}
+
+	log.Printf("[MASTER] local worker %s failed (%s); restarting\n", instanceName, err.Error())
+	go func() {
+		time.Sleep(localRestartDelay)
+
+		provider.mutex.Lock()
+		defer provider.mutex.Unlock()
+
+		if instance.deleted {
+			return
+		}
+		if err := provider.start(instanceName, instance); err != nil {
+			log.Println(err)
+			provider.forget(instanceName, instance)
+		}
+	}()
+}
+
+// forget removes the instance which is not restarted, so that the map does not grow with exited workers.
+// The caller must hold the mutex.
+func (provider *LocalProvider) forget(instanceName string, instance *LocalInstance) {
+	// the name may be taken by a new instance after this one is deleted
+	if provider.instances[instanceName] == instance {
+		delete(provider.instances, instanceName)
+	}
+}
+
+func (provider *LocalProvider) Create(instanceName, machineName string) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if _, ok := provider.instances[instanceName]; ok {
+		return errors.New("instance " + instanceName + " already exists")
+	}
+
+	instance := &LocalInstance{}
+	if err := provider.start(instanceName, instance); err != nil {
+		return err
+	}
+	provider.instances[instanceName] = instance
+
+	log.Printf("[MASTER] local worker %s started\n", instanceName)
+
+	return nil
+}
+
+func (provider *LocalProvider) List() ([]string, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	res := make([]string, 0)
+	for name, instance := range provider.instances {
+		if !instance.exited {
+			res = append(res, name)
+		}
+	}
+
+	return res, nil
+}
+
+func (provider *LocalProvider) Delete(instanceName string) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	instance, ok := provider.instances[instanceName]
+	if !ok {
+		return errors.New("unknown instance " + instanceName)
+	}
+
+	instance.deleted = true
+	delete(provider.instances, instanceName)
+
+	if instance.exited {
+		return nil
+	}
+
+	return instance.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+func (provider *LocalProvider) Status(instanceName string) (string, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	instance, ok := provider.instances[instanceName]
+	if !ok {
+		return "", errors.New("unknown instance " + instanceName)
+	}
+
+	if instance.exited {
+		return InstanceTerminated, nil
+	}
+
+	return InstanceRunning, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition until it holds or times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// newTestWorker writes a worker script which records its environment and runs into dir.
+// It fails on the first failures runs and then keeps running, or exits with success if keep is false.
+func newTestWorker(t *testing.T, dir string, failures int, keep bool) string {
+	last := "exit 0"
+	if keep {
+		last = "exec sleep 60"
+	}
+	script := "#!/bin/sh\n" +
+		"env > " + dir + "/env\n" +
+		"echo run >> " + dir + "/runs\n" +
+		"[ $(wc -l < " + dir + "/runs) -le " + strconv.Itoa(failures) + " ] && exit 1\n" +
+		last + "\n"
+
+	path := filepath.Join(dir, "worker.sh")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func runs(dir string) int {
+	data, _ := ioutil.ReadFile(dir + "/runs")
+	return strings.Count(string(data), "run\n")
+}
+
+func listed(provider *LocalProvider, name string) bool {
+	names, _ := provider.List()
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func testEnv() WorkerEnv {
+	return WorkerEnv{RedisHost: "localhost:6379", BlobStore: "redis:", CacheSize: 1024, Renderer: "test"}
+}
+
+func TestLocalProviderCreateListDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	provider := newLocalProvider(newTestWorker(t, dir, 0, true), testEnv())
+
+	if err := provider.Create("worker-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Create("worker-1", ""); err == nil {
+		t.Error("Create of an existing instance succeeded")
+	}
+	if !listed(provider, "worker-1") {
+		t.Error("List does not have the created instance")
+	}
+	if status, err := provider.Status("worker-1"); err != nil || status != InstanceRunning {
+		t.Errorf("Status = %s, %v", status, err)
+	}
+
+	waitFor(t, "the worker to start", func() bool { return runs(dir) == 1 })
+	env, _ := ioutil.ReadFile(dir + "/env")
+	for _, v := range testEnv().vars("worker-1") {
+		if !strings.Contains(string(env), v+"\n") {
+			t.Errorf("the worker does not have %s", v)
+		}
+	}
+
+	if err := provider.Delete("worker-1"); err != nil {
+		t.Fatal(err)
+	}
+	if listed(provider, "worker-1") {
+		t.Error("List has the deleted instance")
+	}
+	if _, err := provider.Status("worker-1"); err == nil {
+		t.Error("Status of the deleted instance succeeded")
+	}
+	if err := provider.Delete("worker-1"); err == nil {
+		t.Error("Delete of the deleted instance succeeded")
+	}
+
+	// the name is available again, and the deleted worker is not restarted
+	if err := provider.Create("worker-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the new worker to start", func() bool { return runs(dir) == 2 })
+	provider.Delete("worker-1")
+}
+
+func TestLocalProviderRestart(t *testing.T) {
+	defer func(delay time.Duration) { localRestartDelay = delay }(localRestartDelay)
+	localRestartDelay = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	provider := newLocalProvider(newTestWorker(t, dir, 2, true), testEnv())
+	if err := provider.Create("worker-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Delete("worker-1")
+
+	// the failed worker is restarted until it keeps running
+	waitFor(t, "the worker to be restarted", func() bool { return runs(dir) == 3 })
+	waitFor(t, "the worker to be listed", func() bool { return listed(provider, "worker-1") })
+	if status, err := provider.Status("worker-1"); err != nil || status != InstanceRunning {
+		t.Errorf("Status = %s, %v", status, err)
+	}
+}
+
+func TestLocalProviderExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	provider := newLocalProvider(newTestWorker(t, dir, 0, false), testEnv())
+	if err := provider.Create("worker-1", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker exiting with success is forgotten and not restarted
+	waitFor(t, "the worker to be forgotten", func() bool {
+		_, err := provider.Status("worker-1")
+		return err != nil
+	})
+	if listed(provider, "worker-1") {
+		t.Error("List has the exited instance")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := runs(dir); n != 1 {
+		t.Errorf("the worker ran %d times", n)
+	}
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"image"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RenderQueued    = "Queued"
+	RenderStarted   = "Started"
+	RenderDone      = "Done"
+	RenderFailed    = "Failed"
+	RenderTimeout   = "Timeout"
+	RenderCancelled = "Cancelled"
+)
+
+// Sample is a message pushed to render-queue on behalf of a render.
+type Sample struct {
+	Message   Message
+	Marshaled []byte
+}
+
+// Render is a render requested by a client.
+// It consists of one or more samples, each of which is dispatched to a worker as a Message.
+type Render struct {
+	Id         string
+	SessionId  string
+	Parallel   int
+	TileCols   int
+	TileRows   int
+	Timeout    int  // seconds; 0 means no limit
+	FloatImage bool // ask workers for float images instead of JPEG
+	Quality    int  // quality of the JPEG of samples; 0 for the default of workers
+	CreatedOn  time.Time
+	FinishedOn time.Time
+
+	// adaptive sampling dispatches batches of Parallel samples per tile until the estimated
+	// relative error drops below Noise, the next batch would exceed MaxSamples or Budget runs out
+	Noise      float64 // 0 disables adaptive sampling
+	MaxSamples int     // samples per pixel of each tile, counted by the samples renderers report, or one per image if they do not
+	Budget     int     // seconds; 0 means no limit
+
+	mutex    sync.Mutex
+	status   string
+	started  int
+	finished int
+	err      error
+	ack      []byte
+	image    *FloatImage
+	done     chan struct{}
+
+	// errorEstimate is the relative standard error of the mean after the last finished batch, if estimated
+	batches       int
+	errorEstimate float64
+	estimated     bool
+
+	// accum holds the samples finished so far, accumulated in linear space so that HDR values survive averaging;
+	// preview is their mean computed on demand, and updated is closed and replaced whenever a sample is added
+	accum   Accumulator
+	preview *FloatImage
+	updated chan struct{}
+
+	cancel     chan struct{}
+	cancelOnce sync.Once
+}
+
+// RenderStatus is a snapshot of a render returned to the client.
+type RenderStatus struct {
+	RenderId  string
+	SessionId string
+	State     string
+	Parallel  int
+	Tiles     int
+	Started   int
+	Finished  int
+	Progress  float64
+	Batches   int
+	Error     *float64 `json:",omitempty"`
+	Log       string   `json:",omitempty"`
+}
+
+func newRender(session string, parallel int, tileCols int, tileRows int, timeout int) *Render {
+	return &Render{
+		Id:        strconv.FormatInt(time.Now().UnixNano(), 10),
+		SessionId: session,
+		Parallel:  parallel,
+		TileCols:  tileCols,
+		TileRows:  tileRows,
+		Timeout:   timeout,
+		CreatedOn: time.Now(),
+		status:    RenderQueued,
+		done:      make(chan struct{}),
+		updated:   make(chan struct{}),
+		cancel:    make(chan struct{})}
+}
+
+// jobs returns the number of samples dispatched to workers; every tile is rendered Parallel times.
+func (render *Render) jobs() int {
+	return render.Parallel * render.TileCols * render.TileRows
+}
+
+func (render *Render) requestCancel() {
+	render.cancelOnce.Do(func() {
+		close(render.cancel)
+	})
+}
+
+func (render *Render) batchDispatched() {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	render.batches++
+}
+
+func (render *Render) batchFinished(errorEstimate float64) {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	if !math.IsInf(errorEstimate, 0) {
+		render.errorEstimate = errorEstimate
+		render.estimated = true
+	}
+}
+
+func (render *Render) sampleStarted() {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	render.started++
+	if render.status == RenderQueued {
+		render.status = RenderStarted
+	}
+}
+
+// sampleFinished accumulates the image of a finished sample rendered with weight samples per pixel.
+func (render *Render) sampleFinished(img *FloatImage, weight float32) {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	render.accum.add(img, weight)
+	render.finished++
+	render.preview = nil
+	close(render.updated)
+	render.updated = make(chan struct{})
+}
+
+// relativeError returns the estimated error of the accumulated samples; see Accumulator.relativeError.
+func (render *Render) relativeError() float64 {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	return render.accum.relativeError()
+}
+
+// mean returns the mean of the accumulated samples, which is computed once per update only when it is asked.
+// The caller must hold the mutex.
+func (render *Render) mean() *FloatImage {
+	if render.preview == nil && render.finished > 0 {
+		render.preview = render.accum.mean()
+	}
+	return render.preview
+}
+
+// progress returns the current preview, the number of finished samples and a channel closed on the next update.
+func (render *Render) progress() (*FloatImage, int, chan struct{}) {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	return render.mean(), render.finished, render.updated
+}
+
+func (render *Render) finish(status string, err error, ack []byte, image *FloatImage) {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	render.status = status
+	render.err = err
+	render.ack = ack
+	render.image = image
+	render.FinishedOn = time.Now()
+	close(render.done)
+}
+
+func (render *Render) isFinished() bool {
+	select {
+	case <-render.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (render *Render) snapshot() RenderStatus {
+	render.mutex.Lock()
+	defer render.mutex.Unlock()
+
+	status := RenderStatus{
+		RenderId:  render.Id,
+		SessionId: render.SessionId,
+		State:     render.status,
+		Parallel:  render.Parallel,
+		Tiles:     render.TileCols * render.TileRows,
+		Started:   render.started,
+		Finished:  render.finished,
+		Progress:  float64(render.finished) / float64(imax(render.batches, 1)*render.jobs()),
+		Batches:   render.batches}
+
+	if render.estimated {
+		errorEstimate := render.errorEstimate
+		status.Error = &errorEstimate
+	}
+
+	if render.err != nil {
+		status.Log = render.err.Error()
+	} else if render.ack != nil {
+		status.Log = string(render.ack)
+	}
+
+	return status
+}
+
+// RenderTable holds renders which are running or recently finished so that clients can poll them.
+type RenderTable struct {
+	mutex     sync.Mutex
+	renders   map[string]*Render
+	redisPool *redis.Pool
+}
+
+func newRenderTable(redisPool *redis.Pool) *RenderTable {
+	return &RenderTable{renders: make(map[string]*Render), redisPool: redisPool}
+}
+
+func (table *RenderTable) add(render *Render) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	table.renders[render.Id] = render
+}
+
+func (table *RenderTable) get(renderId string) *Render {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	return table.renders[renderId]
+}
+
+func cleanupRenders(table *RenderTable) {
+	for {
+		config := getConfig()
+		time.Sleep(time.Duration(config.RenderCleanupInterval) * time.Minute)
+
+		table.mutex.Lock()
+		for renderId, render := range table.renders {
+			if render.isFinished() && time.Now().Sub(render.FinishedOn) > time.Duration(config.RenderExpire)*time.Minute {
+				if verbose {
+					log.Printf("[MASTER] render %s expired\n", renderId)
+				}
+				delete(table.renders, renderId)
+			}
+		}
+		table.mutex.Unlock()
+	}
+}
+
+// releaseHashes releases the resources of the hashes for protocol.RequeueInflightRenders.
+func releaseHashes(conn redis.Conn) func(hashes []string) {
+	return func(hashes []string) {
+		resources := make([]Resource, 0, len(hashes))
+		for _, hash := range hashes {
+			resources = append(resources, Resource{Hash: hash})
+		}
+		releaseResources(resources, conn)
+	}
+}
+
+func releaseResources(resources []Resource, conn redis.Conn) {
+	for _, resource := range resources {
+		success := false
+		for i := 0; i < 5; i++ {
+			err := releaseResource(resource.Hash, conn)
+			if err == nil {
+				success = true
+				break
+			}
+			log.Printf("[MASTER] retry deleting resource %s\n", resource.Hash)
+			time.Sleep(200 * time.Microsecond)
+		}
+		if !success {
+			log.Printf("[MASTER] failed to release resource %s\n", resource.Hash)
+		}
+	}
+}
+
+// cancelSample removes the sample from render-queue if it is not popped yet,
+// and otherwise asks the worker running it to stop.
+func cancelSample(sample *Sample, conn redis.Conn) {
+	renderId := sample.Message.RenderId
+
+	removed, err := conn.Do("LREM", "render-queue", 0, sample.Marshaled)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if removed.(int64) > 0 {
+		if verbose {
+			log.Printf("[MASTER] sample %s removed from render-queue\n", renderId)
+		}
+
+		releaseResources(sample.Message.Resources, conn)
+
+		// ack on behalf of the worker so that the result receiver is released
+		ack, _ := json.Marshal(&LteAck{RenderId: renderId, Status: "Cancelled"})
+		if _, err := conn.Do("RPUSH", "lte-ack", ack); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if verbose {
+		log.Printf("[MASTER] sample %s is running; sending cancel\n", renderId)
+	}
+
+	// the flag covers the case a worker has popped the sample but not subscribed its cancellation yet
+	conn.Send("MULTI")
+	conn.Send("SET", "render_cancelled:"+renderId, 1)
+	conn.Send("EXPIRE", "render_cancelled:"+renderId, renderCancelTtl*60)
+	conn.Send("PUBLISH", "render-cancel", renderId)
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.Println(err)
+	}
+}
+
+// cancelSamples cancels all unfinished samples of a render,
+// including ones which are still waiting to be dispatched.
+func cancelSamples(samples map[string]*Sample, undispatched int, res chan Result, redisPool *redis.Pool) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, sample := range samples {
+		cancelSample(sample, conn)
+	}
+
+	for undispatched > 0 {
+		received := <-res
+		if received.Dispatched != nil {
+			cancelSample(received.Dispatched, conn)
+			undispatched--
+		} else if received.DispatchFailed {
+			undispatched--
+		}
+	}
+}
+
+// runRender dispatches the samples of the render and accumulates their results.
+func runRender(render *Render, request chan RenderRequest, redisPool *redis.Pool) {
+	// the resources are not referenced by the render but by each sample from its dispatch, since
+	// cancelSample releases them only if the sample is removed from render-queue before a worker pops it
+
+	jobs := render.jobs()
+
+	// each sample sends Dispatched, Started on each attempt and the final one
+	res := make(chan Result, (2+getConfig().RenderMaxAttempts)*jobs)
+
+	dispatchBatch := func() {
+		render.batchDispatched()
+		for y := 0; y < render.TileRows; y++ {
+			for x := 0; x < render.TileCols; x++ {
+				// the whole frame is not a tile so that workers render it as before
+				var tile *Tile
+				if render.TileCols*render.TileRows > 1 {
+					tile = &Tile{X: x, Y: y, Cols: render.TileCols, Rows: render.TileRows}
+				}
+				for i := 0; i < render.Parallel; i++ {
+					request <- RenderRequest{SessionId: render.SessionId, Timeout: render.Timeout, FloatImage: render.FloatImage, Quality: render.Quality, Tile: tile, ResultChan: res}
+				}
+			}
+		}
+	}
+
+	dispatchBatch()
+
+	var deadline <-chan time.Time
+	if render.Timeout > 0 {
+		deadline = time.After(time.Duration(render.Timeout) * time.Second)
+	}
+
+	// the budget stops dispatching new batches; the running batch is still waited for
+	var budget <-chan time.Time
+	if render.Budget > 0 {
+		budget = time.After(time.Duration(render.Budget) * time.Second)
+	}
+	budgetExhausted := false
+
+	samples := make(map[string]*Sample)
+	undispatched := jobs
+
+	// samples per pixel of each tile rendered so far, and of the running batch
+	var tileSamples, batchSamples float64
+	tiles := float64(render.TileCols * render.TileRows)
+
+	for pending := jobs; pending > 0; {
+		var received Result
+		select {
+		case received = <-res:
+		case <-budget:
+			budgetExhausted = true
+			budget = nil
+			continue
+		case <-render.cancel:
+			ack, _ := json.Marshal(&LteAck{RenderId: render.Id, Status: "Cancelled"})
+			render.finish(RenderCancelled, nil, ack, nil)
+			cancelSamples(samples, undispatched, res, redisPool)
+			return
+		case <-deadline:
+			ack, _ := json.Marshal(&LteAck{RenderId: render.Id, Status: "Timeout",
+				Log: "render did not finish in " + strconv.Itoa(render.Timeout) + " seconds"})
+			render.finish(RenderTimeout, nil, ack, nil)
+			cancelSamples(samples, undispatched, res, redisPool)
+			return
+		}
+
+		if received.Dispatched != nil {
+			samples[received.Dispatched.Message.RenderId] = received.Dispatched
+			undispatched--
+			continue
+		}
+
+		if received.DispatchFailed {
+			undispatched--
+		}
+
+		if received.Started {
+			render.sampleStarted()
+			continue
+		}
+
+		delete(samples, received.SampleId)
+
+		if received.Err != nil {
+			render.finish(RenderFailed, received.Err, nil, nil)
+			cancelSamples(samples, undispatched, res, redisPool)
+			return
+		}
+
+		if received.Ack != nil {
+			var ack LteAck
+			json.Unmarshal(received.Ack, &ack)
+			if ack.Status == "Timeout" {
+				render.finish(RenderTimeout, nil, received.Ack, nil)
+			} else {
+				render.finish(RenderFailed, nil, received.Ack, nil)
+			}
+			cancelSamples(samples, undispatched, res, redisPool)
+			return
+		}
+
+		if received.Cancelled {
+			ack, _ := json.Marshal(&LteAck{RenderId: render.Id, Status: "Cancelled"})
+			render.finish(RenderCancelled, nil, ack, nil)
+			cancelSamples(samples, undispatched, res, redisPool)
+			return
+		}
+
+		curImg, err := decodeSample(&received)
+		if err != nil {
+			render.finish(RenderFailed, err, nil, nil)
+			cancelSamples(samples, undispatched, res, redisPool)
+			return
+		}
+
+		render.sampleFinished(curImg, float32(received.Samples))
+		if received.Samples > 0 {
+			batchSamples += float64(received.Samples) / tiles
+		} else {
+			batchSamples += 1 / tiles
+		}
+
+		pending--
+
+		if pending == 0 {
+			errorEstimate := render.relativeError()
+			render.batchFinished(errorEstimate)
+
+			render.mutex.Lock()
+			batches := render.batches
+			render.mutex.Unlock()
+
+			// the next batch is assumed to render as many samples as this one
+			tileSamples += batchSamples
+			nextSamples := batchSamples
+			batchSamples = 0
+
+			if render.Noise > 0 && errorEstimate > render.Noise && !budgetExhausted &&
+				tileSamples+nextSamples <= float64(render.MaxSamples) {
+				if verbose {
+					log.Printf("[MASTER] render %s: error %f after %d batches; dispatching another\n", render.Id, errorEstimate, batches)
+				}
+				dispatchBatch()
+				undispatched += jobs
+				pending += jobs
+			}
+		}
+	}
+
+	render.mutex.Lock()
+	mean := render.mean()
+	render.mutex.Unlock()
+
+	render.finish(RenderDone, nil, nil, mean)
+}
+
+// Accumulator computes the per pixel mean of sample images weighted by their samples per pixel.
+// Images may have different extents; the result covers all of them, which also stitches tiles.
+// It also keeps per pixel luminance moments to estimate the error of the mean.
+type Accumulator struct {
+	sum    *FloatImage
+	weight []float32 // per pixel
+
+	// weighted sums of luminance and its square, and the number of images per pixel
+	lumSum   []float64
+	lumSqSum []float64
+	count    []int
+}
+
+// add accumulates the image rendered with weight samples per pixel.
+// Images of renderers which do not report samples per pixel have weight 0, and are weighted as one sample.
+func (accum *Accumulator) add(img *FloatImage, weight float32) {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	if accum.sum == nil {
+		pixels := img.Rect.Dx() * img.Rect.Dy()
+		accum.sum = newFloatImage(img.Rect)
+		accum.weight = make([]float32, pixels)
+		accum.lumSum = make([]float64, pixels)
+		accum.lumSqSum = make([]float64, pixels)
+		accum.count = make([]int, pixels)
+	} else if !img.Rect.In(accum.sum.Rect) {
+		accum.grow(accum.sum.Rect.Union(img.Rect))
+	}
+
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i, j := accum.sum.offset(x, y), img.offset(x, y)
+			for c := 0; c < 4; c++ {
+				accum.sum.Pix[i+c] += weight * img.Pix[j+c]
+			}
+			accum.weight[i/4] += weight
+
+			lum := float64(luminance(img.Pix[j:]))
+			accum.lumSum[i/4] += float64(weight) * lum
+			accum.lumSqSum[i/4] += float64(weight) * lum * lum
+			accum.count[i/4]++
+		}
+	}
+}
+
+func (accum *Accumulator) grow(rect image.Rectangle) {
+	pixels := rect.Dx() * rect.Dy()
+	sum := newFloatImage(rect)
+	weight := make([]float32, pixels)
+	lumSum := make([]float64, pixels)
+	lumSqSum := make([]float64, pixels)
+	count := make([]int, pixels)
+
+	old := accum.sum
+	for y := old.Rect.Min.Y; y < old.Rect.Max.Y; y++ {
+		for x := old.Rect.Min.X; x < old.Rect.Max.X; x++ {
+			i, j := sum.offset(x, y), old.offset(x, y)
+			copy(sum.Pix[i:i+4], old.Pix[j:j+4])
+			weight[i/4] = accum.weight[j/4]
+			lumSum[i/4] = accum.lumSum[j/4]
+			lumSqSum[i/4] = accum.lumSqSum[j/4]
+			count[i/4] = accum.count[j/4]
+		}
+	}
+
+	accum.sum = sum
+	accum.weight = weight
+	accum.lumSum = lumSum
+	accum.lumSqSum = lumSqSum
+	accum.count = count
+}
+
+func luminance(pix []float32) float32 {
+	return 0.2126*pix[0] + 0.7152*pix[1] + 0.0722*pix[2]
+}
+
+// relativeError estimates the RMS standard error of the mean luminance relative to the mean luminance.
+// An image which is the mean of w samples is assumed to have variance sigma^2 / w,
+// so sigma^2 is estimated from the weighted deviations of the images and the error of the mean is sigma^2 / W.
+// It returns +Inf until some pixel has two or more images.
+func (accum *Accumulator) relativeError() float64 {
+	var varianceSum, lumSum float64
+	covered := 0
+
+	for p, n := range accum.count {
+		if n < 2 {
+			continue
+		}
+		weight := float64(accum.weight[p])
+		mean := accum.lumSum[p] / weight
+		sigma2 := math.Max(0, (accum.lumSqSum[p]-weight*mean*mean)/float64(n-1))
+		varianceSum += sigma2 / weight
+		lumSum += mean
+		covered++
+	}
+
+	if covered == 0 {
+		return math.Inf(1)
+	}
+
+	rms := math.Sqrt(varianceSum / float64(covered))
+	return rms / math.Max(lumSum/float64(covered), 1e-4)
+}
+
+// mean returns the weighted mean; pixels which no sample covers are left black and transparent.
+func (accum *Accumulator) mean() *FloatImage {
+	img := newFloatImage(accum.sum.Rect)
+
+	for p, weight := range accum.weight {
+		if weight == 0 {
+			continue
+		}
+		for c := 0; c < 4; c++ {
+			img.Pix[4*p+c] = accum.sum.Pix[4*p+c] / weight
+		}
+	}
+
+	return img
+}
+
+// decodeSample returns the float image of a sample, or the JPEG or PNG one converted to linear space,
+// placed at the offset of its tile.
+func decodeSample(received *Result) (*FloatImage, error) {
+	var img *FloatImage
+	if received.FloatImage != nil {
+		var err error
+		if img, err = decodePfm(received.FloatImage); err != nil {
+			return nil, err
+		}
+	} else {
+		decoded, _, err := image.Decode(bytes.NewBuffer(received.Image))
+		if err != nil {
+			return nil, err
+		}
+		img = floatImageFromImage(decoded)
+	}
+
+	img.Rect = img.Rect.Sub(img.Rect.Min).Add(received.Offset)
+
+	return img, nil
+}
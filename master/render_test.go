@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// solidImage returns an image over rect whose pixels are all the gray value v.
+func solidImage(rect image.Rectangle, v float32) *FloatImage {
+	img := newFloatImage(rect)
+	for i := range img.Pix {
+		img.Pix[i] = v
+		if i%4 == 3 {
+			img.Pix[i] = 1
+		}
+	}
+	return img
+}
+
+func TestAccumulatorWeightedMean(t *testing.T) {
+	rect := image.Rect(0, 0, 2, 2)
+
+	var accum Accumulator
+	accum.add(solidImage(rect, 1), 1)
+	accum.add(solidImage(rect, 4), 3)
+	// renderers which do not report samples are weighted as one sample
+	accum.add(solidImage(rect, 2), 0)
+
+	mean := accum.mean()
+	if mean.Rect != rect {
+		t.Fatalf("rect = %v", mean.Rect)
+	}
+	want := float32(1*1+4*3+2*1) / 5
+	for i, v := range mean.Pix {
+		if i%4 == 3 {
+			if v != 1 {
+				t.Errorf("alpha at %d = %f", i, v)
+			}
+		} else if math.Abs(float64(v-want)) > 1e-6 {
+			t.Errorf("pix at %d = %f, want %f", i, v, want)
+		}
+	}
+}
+
+func TestAccumulatorTiles(t *testing.T) {
+	var accum Accumulator
+	accum.add(solidImage(image.Rect(0, 0, 2, 1), 1), 1)
+	accum.add(solidImage(image.Rect(2, 1, 4, 2), 3), 1)
+	accum.add(solidImage(image.Rect(2, 1, 4, 2), 5), 1)
+
+	// the result covers all the tiles, leaving the uncovered pixels black and transparent
+	mean := accum.mean()
+	if mean.Rect != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("rect = %v", mean.Rect)
+	}
+	for _, test := range []struct {
+		x, y int
+		v, a float32
+	}{{0, 0, 1, 1}, {1, 0, 1, 1}, {2, 0, 0, 0}, {0, 1, 0, 0}, {3, 1, 4, 1}} {
+		i := mean.offset(test.x, test.y)
+		if mean.Pix[i] != test.v || mean.Pix[i+3] != test.a {
+			t.Errorf("pixel %d,%d = %v, want %f and alpha %f", test.x, test.y, mean.Pix[i:i+4], test.v, test.a)
+		}
+	}
+}
+
+func TestAccumulatorRelativeError(t *testing.T) {
+	rect := image.Rect(0, 0, 1, 1)
+
+	var accum Accumulator
+	accum.add(solidImage(rect, 1), 1)
+	if e := accum.relativeError(); !math.IsInf(e, 1) {
+		t.Errorf("error of one image = %f, want +Inf", e)
+	}
+
+	// the same images have no error
+	accum.add(solidImage(rect, 1), 1)
+	if e := accum.relativeError(); e != 0 {
+		t.Errorf("error of the same images = %f, want 0", e)
+	}
+
+	// luminances 0 and 2: sigma^2 = 2, and the error of the mean is sqrt(2/2) relative to the mean 1
+	var noisy Accumulator
+	noisy.add(solidImage(rect, 0), 1)
+	noisy.add(solidImage(rect, 2), 1)
+	if e := noisy.relativeError(); math.Abs(e-1) > 1e-6 {
+		t.Errorf("error = %f, want 1", e)
+	}
+
+	// more samples reduce the error
+	noisy.add(solidImage(rect, 0), 1)
+	noisy.add(solidImage(rect, 2), 1)
+	if e := noisy.relativeError(); e >= 1 {
+		t.Errorf("error of four images = %f, want less than 1", e)
+	}
+}
@@ -8,15 +8,18 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"github.com/lighttransport/francine/blobstore"
 	"image"
 	"image/color"
 	"image/draw"
-	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -38,6 +41,7 @@ import (
  * @apiGroup Render
  *
  * @apiParam {InputJSON} Input JSON scene filename.
+ * @apiParam {Number} [RenderTimeout] Default timeout of renders in this session in seconds.
  *
  * @apiSuccess {String} SessionId Session ID.
  *
@@ -60,7 +64,8 @@ func restNewSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Poo
 	}
 
 	var requestJson struct {
-		InputJson string
+		InputJson     string
+		RenderTimeout int
 	}
 
 	if reqBody, err := ioutil.ReadAll(r.Body); err != nil {
@@ -77,49 +82,23 @@ func restNewSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Poo
 		log.Println("[MASTER] request read and parsed")
 	}
 
-	redisResp, err := conn.Do("INCR", "lte-counter")
-	if err != nil {
-		raiseHttpError(w, err)
-		return
-	}
-
 	var result struct {
 		SessionId string
 	}
 
-	if verbose {
-		log.Println("[MASTER] incremented redis lte-counter")
-	}
-
-	result.SessionId = strconv.FormatInt(redisResp.(int64), 10)
-
-	marshaled, err := json.Marshal(result)
+	session, err := createSession(requestJson.InputJson, requestJson.RenderTimeout, conn)
 	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
 
-	if verbose {
-		log.Println("[MASTER] result marshaled")
-	}
-
-	conn.Send("MULTI")
-	conn.Send("SADD", "session", result.SessionId)
-	conn.Send("SET", "session:"+result.SessionId+":modified", strconv.FormatInt(time.Now().Unix(), 10))
-	conn.Send("SET", "session:"+result.SessionId+":input-json", requestJson.InputJson)
-	if _, err := conn.Do("EXEC"); err != nil {
-		raiseHttpError(w, err)
-		return
-	}
+	result.SessionId = session
 
 	if verbose {
 		log.Println("[MASTER] wrote input-json to redis")
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-
-	w.Write(marshaled)
+	writeJson(w, http.StatusOK, result)
 
 	if verbose {
 		log.Println("[MASTER] sent all data, finished")
@@ -128,6 +107,28 @@ func restNewSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Poo
 	return
 }
 
+func createSession(inputJson string, renderTimeout int, conn redis.Conn) (string, error) {
+	counter, err := redis.Int64(conn.Do("INCR", "lte-counter"))
+	if err != nil {
+		return "", err
+	}
+
+	session := strconv.FormatInt(counter, 10)
+
+	conn.Send("MULTI")
+	conn.Send("SADD", "session", session)
+	conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
+	conn.Send("SET", "session:"+session+":input-json", inputJson)
+	if renderTimeout > 0 {
+		conn.Send("SET", "session:"+session+":render-timeout", renderTimeout)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return "", err
+	}
+
+	return session, nil
+}
+
 func doesSessionExist(session string, conn redis.Conn) (bool, error) {
 	res, err := conn.Do("EXISTS", "session:"+session+":input-json")
 	if err != nil {
@@ -142,7 +143,7 @@ func doesSessionExist(session string, conn redis.Conn) (bool, error) {
 }
 
 func releaseResource(hash string, conn redis.Conn) error {
-	if _, err := conn.Do("WATCH", "resource:"+hash, "resource:"+hash+":counter"); err != nil {
+	if _, err := conn.Do("WATCH", "resource:"+hash+":counter"); err != nil {
 		return err
 	}
 	counterBytes, err := conn.Do("GET", "resource:"+hash+":counter")
@@ -159,7 +160,9 @@ func releaseResource(hash string, conn redis.Conn) error {
 	if counter > 1 {
 		conn.Send("SET", "resource:"+hash+":counter", counter-1)
 	} else {
-		conn.Send("DEL", "resource:"+hash, "resource:"+hash+":counter")
+		// new references wait in watchResource until the blob is deleted
+		conn.Send("DEL", "resource:"+hash+":counter")
+		conn.Send("SET", "resource:"+hash+":deleting", 1, "EX", resourceDeletingTtl)
 	}
 
 	resp, err := conn.Do("EXEC")
@@ -170,19 +173,76 @@ func releaseResource(hash string, conn redis.Conn) error {
 		return errors.New("optimistic locking failed")
 	}
 
+	// the blob is not referred any more once the counter is deleted
+	if counter <= 1 {
+		// the counter is checked again in case the deleting mark has expired meanwhile
+		if referred, err := redis.Bool(conn.Do("EXISTS", "resource:"+hash+":counter")); err != nil {
+			log.Printf("[MASTER] failed to delete blob %s: %s\n", hash, err.Error())
+		} else if !referred {
+			if err := blobStore.Delete(hash); err != nil {
+				log.Printf("[MASTER] failed to delete blob %s: %s\n", hash, err.Error())
+			}
+		}
+		if _, err := conn.Do("DEL", "resource:"+hash+":deleting"); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// watchResource watches the counter of the blob before a reference to it is taken in MULTI,
+// waiting while releaseResource is deleting the blob, so that the reference never points to a deleted blob.
+func watchResource(hash string, conn redis.Conn) error {
+	for i := 0; i < resourceDeletingTtl*10; i++ {
+		if _, err := conn.Do("WATCH", "resource:"+hash+":counter", "resource:"+hash+":deleting"); err != nil {
+			return err
+		}
+
+		deleting, err := redis.Bool(conn.Do("EXISTS", "resource:"+hash+":deleting"))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if !deleting {
+			return nil
+		}
+
+		conn.Do("UNWATCH")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return errors.New("blob " + hash + " is still being deleted")
+}
+
 func deleteSession(session string, conn redis.Conn) error {
 	members, err := conn.Do("SMEMBERS", "session:"+session+":resource")
 	if err != nil {
 		return err
 	}
+	uploads, err := redis.Strings(conn.Do("SMEMBERS", "session:"+session+":uploads"))
+	if err != nil {
+		return err
+	}
 	_, err = conn.Do("DEL", "session:"+session+":input-json", "session:"+session+":resource",
-		"session:"+session+":modified")
+		"session:"+session+":modified", "session:"+session+":render-timeout", "session:"+session+":uploads")
 	if err != nil {
 		return err
 	}
+	// the files of the uploads being written are removed later by cleanupUploads
+	for _, uploadId := range uploads {
+		if _, err := conn.Do("DEL", "upload:"+uploadId); err != nil {
+			log.Printf("[MASTER] failed to delete upload %s\n", uploadId)
+		}
+		if lockUpload(uploadId) {
+			removeUploadFile(uploadId)
+			unlockUpload(uploadId)
+		}
+	}
+	// sessions without resources are not removed in the loop below
+	if _, err := conn.Do("SREM", "session", session); err != nil {
+		return err
+	}
 	for _, memberBytes := range members.([]interface{}) {
 		member := string(memberBytes.([]byte))
 
@@ -213,312 +273,1113 @@ func deleteSession(session string, conn redis.Conn) error {
 	return nil
 }
 
+// SessionSummary is an item of the session list.
+type SessionSummary struct {
+	SessionId string
+	InputJson string
+	Modified  int64 // unix time
+}
+
 /**
- * @api {delete} /sessions/:SessionId delete session
+ * @api {get} /sessions List sessions
  * @apiVersion v0
- * @apiName NewSession
+ * @apiName ListSessions
  * @apiGroup Render
  *
- * @apiSuccess {String} Status "OK" if success.
+ * @apiDescription List sessions in the order of creation.
+ *
+ * @apiParam {Number} [offset=0] Number of sessions to skip.
+ * @apiParam {Number} [limit=100] Maximum number of sessions to return (up to 1000).
+ * @apiParam {Number} [minAge] List only sessions not modified for this many seconds.
+ * @apiParam {Number} [maxAge] List only sessions modified in this many seconds.
+ *
+ * @apiSuccess {String} Status "Ok" if success.
+ * @apiSuccess {Number} Total Number of sessions which match the filter.
+ * @apiSuccess {Object[]} Sessions SessionId, InputJson and Modified (unix time) of each session.
  *
  * @apiSuccessExample Success-Response:
  *     HTTP/1.1 200 OK
  *     {
- *       "Status": "Ok"
+ *       "Status"  : "Ok",
+ *       "Total"   : 1,
+ *       "Sessions": [
+ *         {
+ *           "SessionId": "1",
+ *           "InputJson": "teapot.json",
+ *           "Modified" : 1418891234
+ *         }
+ *       ]
  *     }
  *
  */
-func restDeleteSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
+func restListSessions(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool) {
 	conn := redisPool.Get()
 	defer conn.Close()
-	var result struct {
-		Status string
-	}
-	{
-		e, err := doesSessionExist(session, conn)
-		if err != nil {
-			raiseHttpError(w, err)
-			return
-		}
 
-		if e == false {
-			result.Status = "SessionDoesNotExist"
+	m, _ := url.ParseQuery(r.URL.RawQuery)
 
-			marshaled, err := json.Marshal(result)
-			if err != nil {
-				raiseHttpError(w, err)
-				return
+	queryInt := func(name string, defaultValue int) int {
+		if m[name] != nil {
+			n, err := strconv.Atoi(m[name][0])
+			if err == nil && n >= 0 {
+				return n
 			}
-
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(marshaled)
-			return
 		}
+		return defaultValue
 	}
 
-	if err := deleteSession(session, conn); err != nil {
+	offset := queryInt("offset", 0)
+	limit := imin(queryInt("limit", 100), 1000)
+	minAge := queryInt("minAge", -1)
+	maxAge := queryInt("maxAge", -1)
+
+	sessions, err := redis.Strings(conn.Do("SMEMBERS", "session"))
+	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
 
-	result.Status = "Ok"
+	// session IDs are numbers given by lte-counter
+	sort.Sort(bySessionId(sessions))
 
-	marshaled, err := json.Marshal(result)
+	conn.Send("MULTI")
+	for _, session := range sessions {
+		conn.Send("GET", "session:"+session+":modified")
+		conn.Send("GET", "session:"+session+":input-json")
+	}
+	resp, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(marshaled)
+	var result struct {
+		Status   string
+		Total    int
+		Sessions []SessionSummary
+	}
+	result.Sessions = make([]SessionSummary, 0)
+
+	now := time.Now().Unix()
+	for i, session := range sessions {
+		if resp[2*i] == nil || resp[2*i+1] == nil {
+			// deleted while listing
+			continue
+		}
+
+		modified, err := strconv.ParseInt(string(resp[2*i].([]byte)), 10, 64)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if (minAge >= 0 && now-modified < int64(minAge)) || (maxAge >= 0 && now-modified > int64(maxAge)) {
+			continue
+		}
+
+		if result.Total >= offset && len(result.Sessions) < limit {
+			result.Sessions = append(result.Sessions, SessionSummary{
+				SessionId: session,
+				InputJson: string(resp[2*i+1].([]byte)),
+				Modified:  modified})
+		}
+		result.Total++
+	}
+
+	result.Status = "Ok"
+
+	writeJson(w, http.StatusOK, result)
+
 	return
 }
 
+type bySessionId []string
+
+func (a bySessionId) Len() int      { return len(a) }
+func (a bySessionId) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySessionId) Less(i, j int) bool {
+	if len(a[i]) != len(a[j]) {
+		return len(a[i]) < len(a[j])
+	}
+	return a[i] < a[j]
+}
+
 /**
- * @api {put} /sessions/:sessionId/resources/:resourceName Add or update resource
+ * @api {get} /sessions/:sessionId Get session
  * @apiVersion v0
- * @apiName EditResource
+ * @apiName GetSession
  * @apiGroup Render
  *
- * @apiParam {binary} Input binary data. Saved as resourceName in the server.
- *
- * @apiSuccess {String} Status "OK" if success.
- * @apiSuccess {String} Name Filename of resource data.
- * @apiSuccess {String} Hash SHA256 hash value of resource data.
- * @apiSuccess {Number} Size of resource data in bytes.
+ * @apiSuccess {String} Status "Ok" if success, "SessionDoesNotExist" if not.
+ * @apiSuccess {String} InputJson Input JSON scene filename.
+ * @apiSuccess {Number} Modified Last modified time in unix time.
+ * @apiSuccess {Number} RenderTimeout Default timeout of renders in this session in seconds, if set.
+ * @apiSuccess {Object[]} Resources Name, Hash and Size of each resource.
  *
  * @apiSuccessExample Success-Response:
  *     HTTP/1.1 200 OK
  *     {
- *       "Status": "OK",
- *       "Name"  : "teapot.mesh",
- *       "Size"  : 1024,
- *       "Hash"  : "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *       "Status"   : "Ok",
+ *       "SessionId": "1",
+ *       "InputJson": "teapot.json",
+ *       "Modified" : 1418891234,
+ *       "Resources": [
+ *         {
+ *           "Name": "teapot.mesh",
+ *           "Hash": "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *           "Size": 1024
+ *         }
+ *       ]
  *     }
  *
  */
-func restEditResource(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, resource string) {
+func restGetSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
 	conn := redisPool.Get()
 	defer conn.Close()
 
+	type ResourceInfo struct {
+		Name string
+		Hash string
+		Size int64
+	}
+
 	var result struct {
-		Status string
-		Name   string
-		Hash   string
-		Size   int // Up to 2GB
+		Status        string
+		SessionId     string         `json:",omitempty"`
+		InputJson     string         `json:",omitempty"`
+		Modified      int64          `json:",omitempty"`
+		RenderTimeout int            `json:",omitempty"`
+		Resources     []ResourceInfo `json:",omitempty"`
 	}
 
-	data, err := ioutil.ReadAll(r.Body)
+	writeResult := func() {
+		writeJson(w, http.StatusOK, result)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("GET", "session:"+session+":input-json")
+	conn.Send("GET", "session:"+session+":modified")
+	conn.Send("GET", "session:"+session+":render-timeout")
+	conn.Send("SMEMBERS", "session:"+session+":resource")
+	resp, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
 
-	{
-		e, err := doesSessionExist(session, conn)
-		if err != nil {
-			raiseHttpError(w, err)
-			return
-		}
-
-		if e == false {
-			result.Status = "SessionDoesNotExist"
-
-			marshaled, err := json.Marshal(result)
-			if err != nil {
-				raiseHttpError(w, err)
-				return
-			}
-
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(marshaled)
-			return
-		}
+	if resp[0] == nil {
+		result.Status = "SessionDoesNotExist"
+		writeResult()
+		return
 	}
 
-	if verbose {
-		log.Printf("[MASTER] putting resource %s (%d bytes)\n", resource, len(data))
+	result.SessionId = session
+	result.InputJson = string(resp[0].([]byte))
+	if resp[1] != nil {
+		result.Modified, _ = strconv.ParseInt(string(resp[1].([]byte)), 10, 64)
+	}
+	if resp[2] != nil {
+		result.RenderTimeout, _ = strconv.Atoi(string(resp[2].([]byte)))
 	}
 
-	hashBytes := sha256.Sum256(data)
-	hash := hex.EncodeToString(hashBytes[:])
-
-	prevHash, err := conn.Do("GET", "session:"+session+":resource:"+resource)
+	names, err := redis.Strings(resp[3], nil)
 	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
-
-	if prevHash != nil {
-		success := false
-		for i := 0; i < 5; i++ {
-			err = releaseResource(string(prevHash.([]byte)), conn)
-			if err == nil {
-				success = true
-				break
-			}
-			time.Sleep(200 * time.Microsecond)
-			if verbose {
-				log.Printf("[MASTER] retry deleting resource %s\n", prevHash)
-			}
-		}
-		if !success {
-			if verbose {
-				log.Printf("[MASTER] failed to release resource %s\n", prevHash)
-			}
-		}
-	}
+	sort.Strings(names)
 
 	conn.Send("MULTI")
-	conn.Send("SET", "resource:"+hash, data)
-	conn.Send("INCR", "resource:"+hash+":counter")
-	conn.Send("SET", "session:"+session+":resource:"+resource, hash)
-	conn.Send("SADD", "session:"+session+":resource", resource)
-	conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
-	if _, err := conn.Do("EXEC"); err != nil {
-		raiseHttpError(w, err)
-		return
+	for _, name := range names {
+		conn.Send("GET", "session:"+session+":resource:"+name)
 	}
-
-	result.Status = "Ok"
-	result.Name = resource
-	result.Hash = hash
-	result.Size = len(data)
-
-	marshaled, err := json.Marshal(result)
+	hashes, err := redis.Values(conn.Do("EXEC"))
 	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(marshaled)
+	result.Resources = make([]ResourceInfo, 0)
+	for i, name := range names {
+		if hashes[i] == nil {
+			continue
+		}
+		size, _, err := blobStore.Stat(string(hashes[i].([]byte)))
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+		result.Resources = append(result.Resources, ResourceInfo{
+			Name: name,
+			Hash: string(hashes[i].([]byte)),
+			Size: size})
+	}
+
+	result.Status = "Ok"
+	writeResult()
 
 	return
 }
 
 /**
- * @api {patch} /sessions/:sessionId/resource Update resource
+ * @api {put} /sessions/:sessionId Edit session
  * @apiVersion v0
- * @apiName UpdateResource
+ * @apiName EditSession
  * @apiGroup Render
  *
- * @apiParam {JSON} Input JSON patch.
+ * @apiDescription Change the settings of the session given in newSession. Omitted fields are left unchanged.
  *
- * @apiSuccess {String} Status "OK" if success.
+ * @apiParam {InputJSON} [InputJson] JSON scene filename.
+ * @apiParam {Number} [RenderTimeout] Default timeout of renders in this session in seconds. 0 to use the master config.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "SessionDoesNotExist" if not.
  *
  * @apiSuccessExample Success-Response:
  *     HTTP/1.1 200 OK
  *     {
- *       "Status": "OK",
+ *       "Status": "Ok"
  *     }
  *
  */
-func restPatchResource(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
+func restEditSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
 	conn := redisPool.Get()
 	defer conn.Close()
 
-	var result struct {
-		Status string
+	var requestJson struct {
+		InputJson     *string
+		RenderTimeout *int
 	}
 
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	if reqBody, err := ioutil.ReadAll(r.Body); err != nil {
 		raiseHttpError(w, err)
 		return
-	}
-
-	{
-		e, err := doesSessionExist(session, conn)
-		if err != nil {
+	} else {
+		if err := json.Unmarshal(reqBody, &requestJson); err != nil {
 			raiseHttpError(w, err)
 			return
 		}
-
-		if e == false {
-			result.Status = "SessionDoesNotExist"
-
-			marshaled, err := json.Marshal(result)
-			if err != nil {
-				raiseHttpError(w, err)
-				return
-			}
-
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(marshaled)
-			return
-		}
 	}
 
-	if verbose {
-		log.Printf("[MASTER] patching resource for session %s (%d bytes)\n", session, len(data))
-	}
-
-	// @todo {}
-	//prevHash, err := conn.Do("GET", "session:"+session+":resource:"+resource)
-	//if err != nil {
-	//	raiseHttpError(w, err)
-	//	return
-	//}
-
-	//if prevHash != nil {
-	//	success := false
-	//	for i := 0; i < 5; i++ {
-	//		err = releaseResource(string(prevHash.([]byte)), conn)
-	//		if err == nil {
-	//			success = true
-	//			break
-	//		}
-	//		time.Sleep(200 * time.Microsecond)
-	//		if verbose {
-	//			log.Printf("[MASTER] retry deleting resource %s\n", prevHash)
-	//		}
-	//	}
-	//	if !success {
-	//		if verbose {
-	//			log.Printf("[MASTER] failed to release resource %s\n", prevHash)
-	//		}
-	//	}
-	//}
-
-	//conn.Send("MULTI")
-	//conn.Send("SET", "resource:"+hash, data)
-	//conn.Send("INCR", "resource:"+hash+":counter")
-	//conn.Send("SET", "session:"+session+":resource:"+resource, hash)
-	//conn.Send("SADD", "session:"+session+":resource", resource)
-	//conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
-	//if _, err := conn.Do("EXEC"); err != nil {
-	//	raiseHttpError(w, err)
-	//	return
-	//}
-
-	result.Status = "Ok"
+	var result struct {
+		Status string
+	}
 
-	marshaled, err := json.Marshal(result)
+	e, err := doesSessionExist(session, conn)
 	if err != nil {
 		raiseHttpError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(marshaled)
+	if e == false {
+		result.Status = "SessionDoesNotExist"
+	} else {
+		conn.Send("MULTI")
+		if requestJson.InputJson != nil {
+			conn.Send("SET", "session:"+session+":input-json", *requestJson.InputJson)
+		}
+		if requestJson.RenderTimeout != nil {
+			if *requestJson.RenderTimeout > 0 {
+				conn.Send("SET", "session:"+session+":render-timeout", *requestJson.RenderTimeout)
+			} else {
+				conn.Send("DEL", "session:"+session+":render-timeout")
+			}
+		}
+		conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
+		if _, err := conn.Do("EXEC"); err != nil {
+			raiseHttpError(w, err)
+			return
+		}
 
-	return
-}
+		result.Status = "Ok"
+	}
+
+	writeJson(w, http.StatusOK, result)
 
-func raiseHttpError(w http.ResponseWriter, err error) {
-	log.Println(err)
-	http.Error(w, err.Error(), http.StatusInternalServerError)
 	return
 }
 
-func composeImage(dst *draw.Image, src image.Image, ratio int) {
+/**
+ * @api {delete} /sessions/:SessionId delete session
+ * @apiVersion v0
+ * @apiName NewSession
+ * @apiGroup Render
+ *
+ * @apiSuccess {String} Status "OK" if success.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "Ok"
+ *     }
+ *
+ */
+func restDeleteSession(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+	var result struct {
+		Status string
+	}
+	{
+		e, err := doesSessionExist(session, conn)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if e == false {
+			result.Status = "SessionDoesNotExist"
+
+			writeJson(w, http.StatusOK, result)
+			return
+		}
+	}
+
+	if err := deleteSession(session, conn); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	result.Status = "Ok"
+
+	writeJson(w, http.StatusOK, result)
+	return
+}
+
+/**
+ * @api {put} /sessions/:sessionId/resources/:resourceName Add or update resource
+ * @apiVersion v0
+ * @apiName EditResource
+ * @apiGroup Render
+ *
+ * @apiParam {binary} Input binary data. Saved as resourceName in the server.
+ * @apiHeader {String} [X-Content-SHA256] SHA256 hash value of the data. With an empty body, the blob already stored
+ *                                        with this hash, e.g. by another session, is attached without sending it again.
+ *                                        With a body, the body is verified against the hash.
+ *
+ * @apiSuccess {String} Status "OK" if success.
+ * @apiSuccess {String} Name Filename of resource data.
+ * @apiSuccess {String} Hash SHA256 hash value of resource data.
+ * @apiSuccess {Number} Size of resource data in bytes.
+ * @apiError {String} Status "BlobDoesNotExist" with 404 if no blob has the hash, "HashMismatch" if the body does not match the hash,
+ *                           "InvalidResourceName" if resourceName is not a relative path like "textures/wood.jpg".
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "OK",
+ *       "Name"  : "teapot.mesh",
+ *       "Size"  : 1024,
+ *       "Hash"  : "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *     }
+ *
+ */
+func restEditResource(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, resource string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	var result struct {
+		Status string
+		Name   string
+		Hash   string
+		Size   int // Up to 2GB
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	{
+		e, err := doesSessionExist(session, conn)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if e == false {
+			result.Status = "SessionDoesNotExist"
+
+			writeJson(w, http.StatusOK, result)
+			return
+		}
+	}
+
+	if !isValidResourceName(resource) {
+		result.Status = "InvalidResourceName"
+		result.Name = resource
+
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+
+	statusCode := http.StatusOK
+	contentHash := strings.ToLower(r.Header.Get("X-Content-SHA256"))
+
+	if contentHash != "" && len(data) == 0 {
+		if verbose {
+			log.Printf("[MASTER] linking resource %s to %s\n", resource, contentHash)
+		}
+
+		size, ok, err := linkResource(session, resource, contentHash, conn)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if ok {
+			result.Status = "Ok"
+			result.Size = size
+		} else {
+			result.Status = "BlobDoesNotExist"
+			statusCode = http.StatusNotFound
+		}
+		result.Name = resource
+		result.Hash = contentHash
+	} else {
+		if verbose {
+			log.Printf("[MASTER] putting resource %s (%d bytes)\n", resource, len(data))
+		}
+
+		hashBytes := sha256.Sum256(data)
+		if contentHash != "" && contentHash != hex.EncodeToString(hashBytes[:]) {
+			result.Status = "HashMismatch"
+			result.Name = resource
+			result.Hash = hex.EncodeToString(hashBytes[:])
+			result.Size = len(data)
+		} else {
+			hash, err := storeResource(session, resource, data, conn)
+			if err != nil {
+				raiseHttpError(w, err)
+				return
+			}
+
+			result.Status = "Ok"
+			result.Name = resource
+			result.Hash = hash
+			result.Size = len(data)
+		}
+	}
+
+	writeJson(w, statusCode, result)
+
+	return
+}
+
+// isValidResourceName reports whether the name is a clean relative path without "..",
+// so that the resource cannot be placed out of the render directory on workers.
+// TODO: DRY; the same as worker/worker.go
+func isValidResourceName(name string) bool {
+	if name == "" || name == "." || len(name) > maxResourceNameLength || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getResourceHash returns the hash of the resource of the session, or "" if it does not exist.
+func getResourceHash(session, resource string, conn redis.Conn) (string, error) {
+	hash, err := conn.Do("GET", "session:"+session+":resource:"+resource)
+	if err != nil || hash == nil {
+		return "", err
+	}
+
+	return string(hash.([]byte)), nil
+}
+
+func writeResourceNotFound(w http.ResponseWriter, r *http.Request) {
+	writeNotFound(w, r, "ResourceDoesNotExist")
+}
+
+func writeNotFound(w http.ResponseWriter, r *http.Request, status string) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var result struct {
+		Status string
+	}
+	result.Status = status
+
+	writeJson(w, http.StatusNotFound, result)
+}
+
+/**
+ * @api {get} /sessions/:sessionId/resources/:resourceName Download resource
+ * @apiVersion v0
+ * @apiName GetResource
+ * @apiGroup Render
+ *
+ * @apiDescription Download the resource. HEAD returns only the headers, to check the existence and the hash.
+ * The hash is given as ETag, so If-None-Match and Range requests are supported.
+ *
+ * @apiSuccess {Binary} Resource data.
+ * @apiSuccess {String} X-Content-SHA256 (header) SHA256 hash value of resource data.
+ * @apiError {String} Status "ResourceDoesNotExist" with 404 if the session or the resource does not exist.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     ETag: "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540"
+ *     X-Content-SHA256: 5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540
+ *     Content-Length: 1024
+ *
+ */
+func restGetResource(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, resource string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	hash, err := getResourceHash(session, resource, conn)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if hash == "" {
+		writeResourceNotFound(w, r)
+		return
+	}
+
+	if err := serveBlob(w, r, resource, hash); err == blobstore.ErrBlobNotFound {
+		writeResourceNotFound(w, r)
+	} else if err != nil {
+		raiseHttpError(w, err)
+	}
+
+	return
+}
+
+// serveBlob sends the blob with its hash as ETag. It returns blobstore.ErrBlobNotFound or an error before anything is sent.
+// Range requests are supported also for blobs without random access, by skipping the bytes before the range.
+func serveBlob(w http.ResponseWriter, r *http.Request, name, hash string) error {
+	if r.Method == "HEAD" {
+		size, exists, err := blobStore.Stat(hash)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return blobstore.ErrBlobNotFound
+		}
+
+		w.Header().Set("ETag", "\""+hash+"\"")
+		w.Header().Set("X-Content-SHA256", hash)
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	reader, size, err := blobStore.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	w.Header().Set("ETag", "\""+hash+"\"")
+	w.Header().Set("X-Content-SHA256", hash)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, time.Time{}, seeker)
+		return nil
+	}
+
+	if strings.Trim(r.Header.Get("If-None-Match"), "\"") == hash {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	start, length := int64(0), size
+	status := http.StatusOK
+
+	ifRange := strings.Trim(r.Header.Get("If-Range"), "\"")
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && (ifRange == "" || ifRange == hash) {
+		var ok bool
+		start, length, ok = parseByteRange(rangeHeader, size)
+		if !ok {
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		if length != size {
+			w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(start+length-1, 10)+"/"+strconv.FormatInt(size, 10))
+			status = http.StatusPartialContent
+		}
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if _, err := io.CopyN(ioutil.Discard, reader, start); err != nil {
+		log.Printf("[MASTER] failed to send blob %s: %s\n", hash, err.Error())
+		return nil
+	}
+	if _, err := io.CopyN(w, reader, length); err != nil {
+		log.Printf("[MASTER] failed to send blob %s: %s\n", hash, err.Error())
+	}
+
+	return nil
+}
+
+// parseByteRange parses a single range "bytes=first-last", "bytes=first-" or "bytes=-suffix".
+// Multiple ranges are answered with the whole content. It returns false if the range is not satisfiable.
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, true
+	}
+
+	split := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-", 2)
+	if len(split) != 2 {
+		return 0, size, true
+	}
+
+	if split[0] == "" {
+		suffix, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, true
+	}
+
+	first, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil || first < 0 || first >= size {
+		return 0, 0, false
+	}
+
+	last := size - 1
+	if split[1] != "" {
+		last, err = strconv.ParseInt(split[1], 10, 64)
+		if err != nil || last < first {
+			return 0, 0, false
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+
+	return first, last - first + 1, true
+}
+
+/**
+ * @api {get} /blobs/:hash Download blob
+ * @apiVersion v0
+ * @apiName GetBlob
+ * @apiGroup Render
+ *
+ * @apiDescription Download the blob of the hash, which workers use to fetch resources.
+ * The content never changes, so the hash is given as ETag and If-None-Match, If-Range and Range requests are supported.
+ * HEAD returns only the headers.
+ *
+ * @apiSuccess {Binary} Blob data.
+ * @apiSuccess {String} X-Content-SHA256 (header) SHA256 hash value of blob data.
+ * @apiError {String} Status "BlobDoesNotExist" with 404 if no blob has the hash.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 206 Partial Content
+ *     ETag: "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540"
+ *     Content-Range: bytes 512-1023/1024
+ *     Content-Length: 512
+ *
+ */
+func restGetBlob(w http.ResponseWriter, r *http.Request, hash string) {
+	hash = strings.ToLower(hash)
+	if !blobstore.IsValidHash(hash) {
+		writeNotFound(w, r, "BlobDoesNotExist")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+
+	if err := serveBlob(w, r, hash, hash); err == blobstore.ErrBlobNotFound {
+		w.Header().Del("Cache-Control")
+		writeNotFound(w, r, "BlobDoesNotExist")
+	} else if err != nil {
+		raiseHttpError(w, err)
+	}
+}
+
+/**
+ * @api {delete} /sessions/:sessionId/resources/:resourceName Delete resource
+ * @apiVersion v0
+ * @apiName DeleteResource
+ * @apiGroup Render
+ *
+ * @apiSuccess {String} Status "Ok" if success, "SessionDoesNotExist" or "ResourceDoesNotExist".
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "Ok"
+ *     }
+ *
+ */
+func restDeleteResource(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, resource string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	var result struct {
+		Status string
+	}
+
+	e, err := doesSessionExist(session, conn)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if e == false {
+		result.Status = "SessionDoesNotExist"
+	} else {
+		conn.Send("MULTI")
+		conn.Send("GET", "session:"+session+":resource:"+resource)
+		conn.Send("DEL", "session:"+session+":resource:"+resource)
+		conn.Send("SREM", "session:"+session+":resource", resource)
+		conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
+		resp, err := redis.Values(conn.Do("EXEC"))
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if resp[0] == nil {
+			result.Status = "ResourceDoesNotExist"
+		} else {
+			if verbose {
+				log.Printf("[MASTER] deleted resource %s of session %s\n", resource, session)
+			}
+			releaseResources([]Resource{{resource, string(resp[0].([]byte))}}, conn)
+			result.Status = "Ok"
+		}
+	}
+
+	writeJson(w, http.StatusOK, result)
+
+	return
+}
+
+// storeResource saves data as the content-addressed resource of the session,
+// releasing the reference to the previous content of the resource.
+func storeResource(session, resource string, data []byte, conn redis.Conn) (string, error) {
+	hashBytes := sha256.Sum256(data)
+	hash := hex.EncodeToString(hashBytes[:])
+
+	_, err := referenceBlob(session, resource, hash, func() error {
+		return blobStore.Put(hash, bytes.NewReader(data), int64(len(data)))
+	}, nil, nil, conn)
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// referenceBlob attaches the blob of the hash to the resource of the session, taking a reference to the blob
+// and releasing the one to the previous content of the resource. The blob is checked under the watch, so that it
+// cannot be deleted before the reference is taken, and put is called to store it if it is not stored yet.
+// watch, if not nil, watches and checks other keys the reference depends on, and multi queues other commands
+// to run in the same transaction. The whole is retried when the watched keys are changed meanwhile.
+// It returns the size of the blob if it was already stored, or -1 if put stored it.
+func referenceBlob(session, resource, hash string, put func() error, watch func() error, multi func(), conn redis.Conn) (int64, error) {
+	for i := 0; i < 5; i++ {
+		if err := watchResource(hash, conn); err != nil {
+			return 0, err
+		}
+		if _, err := conn.Do("WATCH", "session:"+session+":resource:"+resource); err != nil {
+			return 0, err
+		}
+		if watch != nil {
+			if err := watch(); err != nil {
+				conn.Do("UNWATCH")
+				return 0, err
+			}
+		}
+
+		size, exists, err := blobStore.Stat(hash)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return 0, err
+		}
+		if !exists {
+			if err := put(); err != nil {
+				conn.Do("UNWATCH")
+				return 0, err
+			}
+			size = -1
+		}
+
+		prevHash, err := conn.Do("GET", "session:"+session+":resource:"+resource)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return 0, err
+		}
+
+		// the new reference is taken before releasing the previous one, which may be the same blob
+		conn.Send("MULTI")
+		if multi != nil {
+			multi()
+		}
+		conn.Send("INCR", "resource:"+hash+":counter")
+		conn.Send("SET", "session:"+session+":resource:"+resource, hash)
+		conn.Send("SADD", "session:"+session+":resource", resource)
+		conn.Send("SET", "session:"+session+":modified", strconv.FormatInt(time.Now().Unix(), 10))
+		resp, err := conn.Do("EXEC")
+		if err != nil {
+			return 0, err
+		}
+		if resp == nil {
+			if verbose {
+				log.Printf("[MASTER] retry referencing resource %s\n", hash)
+			}
+			continue
+		}
+
+		if prevHash != nil {
+			releaseResources([]Resource{{resource, string(prevHash.([]byte))}}, conn)
+		}
+
+		return size, nil
+	}
+
+	return 0, errors.New("optimistic locking failed")
+}
+
+// errResourceModified is returned by the watch of restPatchResource if the resource is not the patched one any more.
+var errResourceModified = errors.New("resource is modified")
+
+// errBlobNotStored is returned by the put of linkResource, which does not send the data of the blob.
+var errBlobNotStored = errors.New("blob is not stored")
+
+// linkResource attaches the blob already stored in the blob store to the session without sending its data.
+// It returns false if no blob of the hash is stored.
+func linkResource(session, resource, hash string, conn redis.Conn) (int, bool, error) {
+	if !blobstore.IsValidHash(hash) {
+		return 0, false, nil
+	}
+
+	size, err := referenceBlob(session, resource, hash, func() error {
+		return errBlobNotStored
+	}, nil, nil, conn)
+	if err == errBlobNotStored {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int(size), true, nil
+}
+
+/**
+ * @api {patch} /sessions/:sessionId/resource Update resource
+ * @apiVersion v0
+ * @apiName UpdateResource
+ * @apiGroup Render
+ *
+ * @apiDescription Apply a patch to a JSON resource and save the result as the new content of the resource.
+ * PATCH /sessions/:sessionId/resources/:resourceName does the same for the resource in the path.
+ * The patch is RFC 6902 JSON Patch if Content-Type is application/json-patch+json,
+ * RFC 7396 JSON Merge Patch if it is application/merge-patch+json,
+ * and otherwise JSON Patch if the body is an array and JSON Merge Patch if not.
+ *
+ * @apiParam {String} [name] Resource to patch. Defaults to InputJson of the session.
+ * @apiParam {JSON} Input JSON patch.
+ * @apiHeader {String} [If-Match] Patch only if the current hash of the resource matches.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "ResourceDoesNotExist", "HashMismatch" or "InvalidPatch".
+ * @apiSuccess {String} Name Filename of resource data.
+ * @apiSuccess {String} Hash SHA256 hash value of the patched resource data.
+ * @apiSuccess {Number} Size of the patched resource data in bytes.
+ * @apiSuccess {String} Log Reason if the patch is invalid or cannot be applied.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "Ok",
+ *       "Name"  : "teapot.json",
+ *       "Size"  : 2048,
+ *       "Hash"  : "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *     }
+ *
+ */
+func restPatchResource(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, resource string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	var result struct {
+		Status string
+		Name   string `json:",omitempty"`
+		Hash   string `json:",omitempty"`
+		Size   int    `json:",omitempty"`
+		Log    string `json:",omitempty"`
+	}
+
+	writeResult := func() {
+		writeJson(w, http.StatusOK, result)
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	{
+		e, err := doesSessionExist(session, conn)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if e == false {
+			result.Status = "SessionDoesNotExist"
+			writeResult()
+			return
+		}
+	}
+
+	if resource == "" {
+		inputJson, err := conn.Do("GET", "session:"+session+":input-json")
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+		if inputJson != nil {
+			resource = string(inputJson.([]byte))
+		}
+	}
+
+	if verbose {
+		log.Printf("[MASTER] patching resource %s for session %s (%d bytes)\n", resource, session, len(data))
+	}
+
+	// the patch is applied again if the resource is changed before the patched content replaces it
+	var newHash string
+	var patched []byte
+	for i := 0; ; i++ {
+		if i == 5 {
+			raiseHttpError(w, errors.New("optimistic locking failed"))
+			return
+		}
+
+		hash, err := conn.Do("GET", "session:"+session+":resource:"+resource)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		if hash == nil {
+			result.Status = "ResourceDoesNotExist"
+			writeResult()
+			return
+		}
+
+		if ifMatch := strings.Trim(r.Header.Get("If-Match"), "\""); ifMatch != "" && ifMatch != string(hash.([]byte)) {
+			result.Status = "HashMismatch"
+			result.Hash = string(hash.([]byte))
+			writeResult()
+			return
+		}
+
+		doc, err := blobstore.ReadAll(blobStore, string(hash.([]byte)))
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+
+		switch contentType := strings.Split(r.Header.Get("Content-Type"), ";")[0]; {
+		case contentType == "application/json-patch+json":
+			patched, err = applyJsonPatch(doc, data)
+		case contentType == "application/merge-patch+json":
+			patched, err = applyMergePatch(doc, data)
+		case strings.HasPrefix(strings.TrimSpace(string(data)), "["):
+			patched, err = applyJsonPatch(doc, data)
+		default:
+			patched, err = applyMergePatch(doc, data)
+		}
+
+		if err != nil {
+			result.Status = "InvalidPatch"
+			result.Log = err.Error()
+			writeResult()
+			return
+		}
+
+		hashBytes := sha256.Sum256(patched)
+		newHash = hex.EncodeToString(hashBytes[:])
+
+		_, err = referenceBlob(session, resource, newHash, func() error {
+			return blobStore.Put(newHash, bytes.NewReader(patched), int64(len(patched)))
+		}, func() error {
+			// the resource is watched by referenceBlob
+			current, err := conn.Do("GET", "session:"+session+":resource:"+resource)
+			if err != nil {
+				return err
+			}
+			if current == nil || string(current.([]byte)) != string(hash.([]byte)) {
+				return errResourceModified
+			}
+			return nil
+		}, nil, conn)
+		if err == errResourceModified {
+			if verbose {
+				log.Printf("[MASTER] resource %s is modified while patching; retrying\n", resource)
+			}
+			continue
+		}
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+		break
+	}
+
+	result.Status = "Ok"
+	result.Name = resource
+	result.Hash = newHash
+	result.Size = len(patched)
+
+	writeResult()
+
+	return
+}
+
+func raiseHttpError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	return
+}
+
+// writeJson writes v in JSON with the status code. The headers must be set before WriteHeader.
+func writeJson(w http.ResponseWriter, statusCode int, v interface{}) {
+	marshaled, err := json.Marshal(v)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(marshaled)
+}
+
+func composeImage(dst *draw.Image, src image.Image, ratio int) {
 	/*
 		out_A = src_A + dst_A(1 - src_A)
 		out_r = src_r * src_A + dst_r * dst_A (1 - src_A) / out_A
@@ -537,143 +1398,441 @@ func composeImage(dst *draw.Image, src image.Image, ratio int) {
 	return
 }
 
-func clamp(f float32) uint16 {
-	i := int32(f * 65535)
-	if i < 0 {
-		i = 0
+/**
+ * @api {post} /sessions/:sessionId/renders Run rendering
+ * @apiVersion v0
+ * @apiName NewRender
+ * @apiGroup Render
+ *
+ * @apiDescription Run rendering and wait until the rendering finishes. This API is blocking operation unless async=1 is given.
+ *
+ * @apiParam {Number} [parallel=1] Number of samples rendered in parallel and averaged.
+ * @apiParam {String} [tiles=1x1] Split the frame into WxH tiles (up to 16x16) rendered by different workers and stitched.
+ *                                Each tile is rendered parallel times. Tiles are "UnsupportedTiles" unless Renderer is "command" or "test".
+ * @apiParam {Number} [async=0] If 1, return RenderId immediately without waiting for the rendering.
+ * @apiParam {Number} [timeout] Timeout in seconds. Defaults to RenderTimeout of the session or of the master config.
+ * @apiParam {Number} [noise] Enable adaptive sampling; keep dispatching batches of parallel samples
+ *                            until the estimated relative error of the mean drops below this value.
+ * @apiParam {Number} [maxSamples=256] Adaptive sampling stops before a batch would render more than this many samples per pixel of a tile,
+ *                                      counted by the samples renderers report, or one per sample image if they do not.
+ * @apiParam {Number} [budget] Adaptive sampling stops dispatching new batches after this many seconds.
+ * @apiParam {String} [format=jpeg] Output format; "jpeg", "png", "png16", "exr", "hdr" or "pfm". The Accept header is used if omitted.
+ *                                  Workers publish float images, or lossless PNG samples if the renderer writes no float image,
+ *                                  unless "jpeg" is requested here; LTE without float images publishes JPEG samples.
+ *                                  HDR formats are "UnsupportedFormat" if LTE on workers does not support float images (LteFloatOutput).
+ * @apiParam {Number} [quality=100] JPEG quality (1-100), which workers also use for the JPEG samples.
+ *
+ * @apiSuccess {Binary} Image file(binary stream) in the requested format.
+ *                       X-Render-Batches and X-Render-Error headers report the number of batches and the final error estimate.
+ * @apiSuccess {String} Status "Ok" if success (async=1).
+ * @apiSuccess {String} RenderId Render ID to poll (async=1).
+ * @apiError {String} Status "LinkError", "Failed", "Timeout", "Cancelled", "UnsupportedFormat" or "UnsupportedTiles".
+ * @apiError {String} Log Detailed error log.
+ *
+ * @apiSuccessExample Success-Response (async=1):
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status"  : "Ok",
+ *       "RenderId": "1418891234567890123"
+ *     }
+ *
+ * @apiErrorExample Error-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "LinkError",
+ *       "Log"   : "File not found: teapot.json"
+ *     }
+ *
+ */
+func restNewRender(w http.ResponseWriter, r *http.Request, request chan RenderRequest, renders *RenderTable, session string, renderTimes int, tileCols int, tileRows int, adaptive AdaptiveSampling, async bool, timeout int, format ImageFormat) {
+	if timeout < 0 {
+		var err error
+		timeout, err = getSessionRenderTimeout(session, renders.redisPool)
+		if err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+	}
+
+	render := newRender(session, renderTimes, tileCols, tileRows, timeout)
+	render.FloatImage = needsFloatImage(format)
+	if format.Name == "jpeg" {
+		render.Quality = format.Quality
+	}
+	render.Noise = adaptive.Noise
+	render.MaxSamples = adaptive.MaxSamples
+	render.Budget = adaptive.Budget
+	renders.add(render)
+
+	go runRender(render, request, renders.redisPool)
+
+	if async {
+		var result struct {
+			Status   string
+			RenderId string
+		}
+		result.Status = "Ok"
+		result.RenderId = render.Id
+
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+
+	<-render.done
+
+	writeRenderResult(w, render, format)
+
+	return
+}
+
+// getSessionRenderTimeout returns the render timeout in seconds set to the session, or the default in the config.
+func getSessionRenderTimeout(session string, redisPool *redis.Pool) (int, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	resp, err := conn.Do("GET", "session:"+session+":render-timeout")
+	if err != nil {
+		return 0, err
+	}
+
+	if resp == nil {
+		return getConfig().RenderTimeout, nil
+	}
+
+	return strconv.Atoi(string(resp.([]byte)))
+}
+
+func writeRenderResult(w http.ResponseWriter, render *Render, format ImageFormat) {
+	render.mutex.Lock()
+	err, ack, image := render.err, render.ack, render.image
+	render.mutex.Unlock()
+
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if ack != nil {
+		writeJson(w, http.StatusOK, json.RawMessage(ack))
+		return
+	}
+
+	var encoded bytes.Buffer
+	if err := encodeImage(&encoded, image, format); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	status := render.snapshot()
+	w.Header().Set("X-Render-Batches", strconv.Itoa(status.Batches))
+	if status.Error != nil {
+		w.Header().Set("X-Render-Error", strconv.FormatFloat(*status.Error, 'g', 6, 64))
+	}
+	w.Header().Set("Content-Type", format.contentType())
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded.Bytes())
+
+	return
+}
+
+func writeUnsupportedFormat(w http.ResponseWriter) {
+	writeStatus(w, "UnsupportedFormat")
+}
+
+func writeStatus(w http.ResponseWriter, status string) {
+	var result struct {
+		Status string
+	}
+	result.Status = status
+
+	writeJson(w, http.StatusOK, result)
+}
+
+func findRender(w http.ResponseWriter, renders *RenderTable, session, renderId string) *Render {
+	render := renders.get(renderId)
+	if render != nil && render.SessionId == session {
+		return render
+	}
+
+	var result struct {
+		Status string
+	}
+	result.Status = "RenderDoesNotExist"
+
+	writeJson(w, http.StatusOK, result)
+	return nil
+}
+
+/**
+ * @api {get} /sessions/:sessionId/renders/:renderId Poll rendering status
+ * @apiVersion v0
+ * @apiName GetRender
+ * @apiGroup Render
+ *
+ * @apiSuccess {String} Status "Ok" if success.
+ * @apiSuccess {String} State One of "Queued", "Started", "Done", "Failed", "Timeout" or "Cancelled".
+ * @apiSuccess {Number} Parallel Number of samples per tile.
+ * @apiSuccess {Number} Tiles Number of tiles.
+ * @apiSuccess {Number} Started Number of samples picked up by workers.
+ * @apiSuccess {Number} Finished Number of samples finished.
+ * @apiSuccess {Number} Progress Finished / (Parallel * Tiles * Batches).
+ * @apiSuccess {Number} Batches Number of batches dispatched; more than 1 only with adaptive sampling.
+ * @apiSuccess {Number} Error Estimated relative error of the mean after the last finished batch, if known.
+ * @apiSuccess {String} Log Error log if failed.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status"   : "Ok",
+ *       "RenderId" : "1418891234567890123",
+ *       "SessionId": "1",
+ *       "State"    : "Started",
+ *       "Parallel" : 4,
+ *       "Tiles"    : 1,
+ *       "Started"  : 4,
+ *       "Finished" : 1,
+ *       "Progress" : 0.25
+ *     }
+ *
+ */
+func restGetRender(w http.ResponseWriter, r *http.Request, renders *RenderTable, session, renderId string) {
+	render := findRender(w, renders, session, renderId)
+	if render == nil {
+		return
+	}
+
+	var result struct {
+		Status string
+		RenderStatus
+	}
+	result.Status = "Ok"
+	result.RenderStatus = render.snapshot()
+
+	writeJson(w, http.StatusOK, result)
+
+	return
+}
+
+/**
+ * @api {get} /sessions/:sessionId/renders/:renderId/image Get rendered image
+ * @apiVersion v0
+ * @apiName GetRenderImage
+ * @apiGroup Render
+ *
+ * @apiParam {String} [format=jpeg] Output format; "jpeg", "png", "png16", "exr", "hdr" or "pfm". The Accept header is used if omitted.
+ * @apiParam {Number} [quality=100] JPEG quality (1-100).
+ *
+ * @apiSuccess {Binary} Image file(binary stream) in the requested format if the render is done.
+ * @apiError {String} Status "RenderNotFinished" if the render is still running, "UnsupportedFormat" if the format is unknown.
+ * @apiError {String} State State of the render.
+ *
+ * @apiErrorExample Error-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "RenderNotFinished",
+ *       "State" : "Queued"
+ *     }
+ *
+ */
+func restGetRenderImage(w http.ResponseWriter, r *http.Request, renders *RenderTable, session, renderId string) {
+	render := findRender(w, renders, session, renderId)
+	if render == nil {
+		return
+	}
+
+	format, err := negotiateImageFormat(r)
+	if err != nil {
+		writeUnsupportedFormat(w)
+		return
+	}
+
+	if !render.isFinished() {
+		var result struct {
+			Status string
+			State  string
+		}
+		result.Status = "RenderNotFinished"
+		result.State = render.snapshot().State
+
+		writeJson(w, http.StatusOK, result)
+		return
+	}
+
+	writeRenderResult(w, render, format)
+
+	return
+}
+
+/**
+ * @api {get} /sessions/:sessionId/renders/:renderId/stream Stream rendering progress
+ * @apiVersion v0
+ * @apiName StreamRender
+ * @apiGroup Render
+ *
+ * @apiDescription Push the image averaged over the finished samples as Server-Sent Events each time a sample finishes.
+ * A "progress" event is sent for every update and a "done" event when the render finishes, after which the stream is closed.
+ * Each event carries the render status of GetRender and the image encoded in base64.
+ *
+ * @apiParam {String} [format=jpeg] Image format of the events; same as GetRenderImage.
+ * @apiParam {Number} [quality=100] JPEG quality (1-100).
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     Content-Type: text/event-stream
+ *
+ *     event: progress
+ *     data: {"RenderId":"1418891234567890123","State":"Started","Parallel":4,"Finished":1,"Progress":0.25,"Image":"/9j/4AAQ..."}
+ *
+ *     event: done
+ *     data: {"RenderId":"1418891234567890123","State":"Done","Parallel":4,"Finished":4,"Progress":1,"Image":"/9j/4AAQ..."}
+ *
+ */
+func restStreamRender(w http.ResponseWriter, r *http.Request, renders *RenderTable, session, renderId string) {
+	render := findRender(w, renders, session, renderId)
+	if render == nil {
+		return
+	}
+
+	format, err := negotiateImageFormat(r)
+	if err != nil {
+		writeUnsupportedFormat(w)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		raiseHttpError(w, errors.New("streaming is not supported"))
+		return
+	}
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sent := 0
+	for {
+		preview, finished, updated := render.progress()
+
+		if finished > sent && !render.isFinished() {
+			if err := writeStreamEvent(w, "progress", render, preview, format); err != nil {
+				log.Println(err)
+				return
+			}
+			flusher.Flush()
+			sent = finished
+		}
+
+		select {
+		case <-updated:
+		case <-render.done:
+			render.mutex.Lock()
+			image := render.image
+			render.mutex.Unlock()
+
+			if err := writeStreamEvent(w, "done", render, image, format); err != nil {
+				log.Println(err)
+			}
+			flusher.Flush()
+			return
+		case <-closed:
+			if verbose {
+				log.Printf("[MASTER] stream of render %s closed by the client\n", render.Id)
+			}
+			return
+		}
 	}
-
-	return uint16(i)
 }
 
-func accumulateImage(dst *[]float32, src image.Image) {
-
-	inBounds := src.Bounds()
-
-	if *dst == nil {
-		*dst = make([]float32, inBounds.Dx()*inBounds.Dy()*4)
+func writeStreamEvent(w http.ResponseWriter, event string, render *Render, img *FloatImage, format ImageFormat) error {
+	var data struct {
+		RenderStatus
+		Image string `json:",omitempty"`
 	}
+	data.RenderStatus = render.snapshot()
 
-	var w = inBounds.Dx()
-
-	for y := inBounds.Min.Y; y < inBounds.Max.Y; y++ {
-		for x := inBounds.Min.X; x < inBounds.Max.X; x++ {
-			r, g, b, a := src.At(x, y).RGBA()
-			(*dst)[4*(y*w+x)+0] += float32(r) / float32(65535.0)
-			(*dst)[4*(y*w+x)+1] += float32(g) / float32(65535.0)
-			(*dst)[4*(y*w+x)+2] += float32(b) / float32(65535.0)
-			(*dst)[4*(y*w+x)+3] += float32(a) / float32(65535.0)
+	if img != nil {
+		var encoded bytes.Buffer
+		if err := encodeImage(&encoded, img, format); err != nil {
+			return err
 		}
+		data.Image = base64.StdEncoding.EncodeToString(encoded.Bytes())
 	}
-}
-
-func divImage(dst []float32, n float32) {
 
-	invN := 1.0 / n
-
-	for i := 0; i < len(dst); i++ {
-		dst[i] *= invN
+	marshaled, err := json.Marshal(data)
+	if err != nil {
+		return err
 	}
+
+	_, err = w.Write([]byte("event: " + event + "\ndata: " + string(marshaled) + "\n\n"))
+	return err
 }
 
 /**
- * @api {post} /sessions/:sessionId/renders Run rendering
+ * @api {delete} /sessions/:sessionId/renders/:renderId Cancel rendering
  * @apiVersion v0
- * @apiName NewRender
+ * @apiName CancelRender
  * @apiGroup Render
  *
- * @apiDescription Run rendering and wait until the rendering finishes. This API is blocking operation.
+ * @apiDescription Remove queued samples of the render and stop the workers running the rest.
  *
- * @apiSuccess {Binary} JPEG file(binary stream).
- * @apiError {String} Status Currently always "LinkError".
- * @apiError {String} Log Detailed error log.
+ * @apiSuccess {String} Status "Ok" if success, "RenderAlreadyFinished" if the render has already finished.
  *
- * @apiErrorExample Error-Response:
+ * @apiSuccessExample Success-Response:
  *     HTTP/1.1 200 OK
  *     {
- *       "Status": "LinkError",
- *       "Log"   : "File not found: teapot.json"
+ *       "Status": "Ok"
  *     }
  *
  */
-
-// type Render struct {
-// 	w              http.ResponseWriter
-// 	r              *http.Request
-// 	redisPool      *redis.Pool
-// 	session        string
-// 	renderTimes    int
-// 	waitingDuration chan time.Duration
-// }
-
-func restNewRender(w http.ResponseWriter, r *http.Request, request chan RenderRequest, session string, renderTimes int) {
-	// TODO: increment reference count of resources while renering is running
-
-	res := make(chan Result, renderTimes)
-
-	for i := 0; i < renderTimes; i++ {
-		request <- RenderRequest{SessionId: session, ResultChan: res}
+func restCancelRender(w http.ResponseWriter, r *http.Request, renders *RenderTable, session, renderId string) {
+	render := findRender(w, renders, session, renderId)
+	if render == nil {
+		return
 	}
 
-	var accum []float32 = nil
-	var bounds image.Rectangle
-
-	for i := 0; i < renderTimes; i++ {
-		received := <-res
-
-		if received.Err != nil {
-			raiseHttpError(w, received.Err)
-			return
-		}
-
-		if received.Ack != nil {
-			w.WriteHeader(http.StatusOK)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(received.Ack)
-			return
-		}
-
-		buf := bytes.NewBuffer(received.Image)
-		curImg, err := jpeg.Decode(buf)
-		if err != nil {
-			raiseHttpError(w, err)
-			return
-		}
-
-		// Assume all image have same extent
-		bounds = curImg.Bounds()
-
-		//composeImage(&composed, curImg, renderTimes)
-		accumulateImage(&accum, curImg)
+	var result struct {
+		Status string
 	}
 
-	divImage(accum, float32(renderTimes))
-
-	outimg := image.NewRGBA(bounds)
-
-	var width = bounds.Dx()
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r := accum[4*(y*width+x)+0]
-			g := accum[4*(y*width+x)+1]
-			b := accum[4*(y*width+x)+2]
-			a := accum[4*(y*width+x)+3]
-			rgba := color.RGBA64{clamp(r), clamp(g), clamp(b), clamp(a)}
-			outimg.Set(x, y, rgba)
-		}
+	if render.isFinished() {
+		result.Status = "RenderAlreadyFinished"
+	} else {
+		render.requestCancel()
+		result.Status = "Ok"
 	}
 
-	var resBuf bytes.Buffer
+	writeJson(w, http.StatusOK, result)
 
-	if err := jpeg.Encode(&resBuf, outimg, &jpeg.Options{Quality: 100}); err != nil {
-		raiseHttpError(w, err)
-		return
-	}
+	return
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.Write(resBuf.Bytes())
+/**
+ * @api {get} /admin/config Show master configuration
+ * @apiVersion v0
+ * @apiName GetConfig
+ * @apiGroup Admin
+ *
+ * @apiDescription Show the configuration currently in effect, including environment overrides and reloads by SIGHUP.
+ * The password in BlobStore, e.g. the secret key of S3, is shown as "***".
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "HttpAddr"      : ":80",
+ *       "Provider"      : "gce",
+ *       "SessionTimeout": 60,
+ *       ...
+ *     }
+ *
+ */
+func restGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, getConfig().redacted())
 
 	return
 }
@@ -693,12 +1852,32 @@ func imin(x, y int) int {
 	}
 }
 
-func restHandler(path string, w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, waitingDuration chan time.Duration, requestChan chan RenderRequest) {
+func restHandler(path string, w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, waitingDuration chan time.Duration, requestChan chan RenderRequest, renders *RenderTable) {
 
 	if verbose {
 		log.Println("[MASTER] rest request: " + path)
 	}
 
+	if matched := regexp.MustCompile("^/blobs/([^/]+)$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restGetBlob(w, r, matched[1])
+			return
+		}
+	}
+
+	if regexp.MustCompile("^/admin/config$").MatchString(path) {
+		if r.Method == "GET" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restGetConfig(w, r)
+			return
+		}
+	}
+
 	if regexp.MustCompile("^/sessions$").MatchString(path) {
 		if r.Method == "POST" {
 			if verbose {
@@ -707,9 +1886,26 @@ func restHandler(path string, w http.ResponseWriter, r *http.Request, redisPool
 			restNewSession(w, r, redisPool)
 			return
 		}
+		if r.Method == "GET" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restListSessions(w, r, redisPool)
+			return
+		}
+	}
+
+	if regexp.MustCompile("^/sessions/import$").MatchString(path) {
+		if r.Method == "POST" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restImportSession(w, r, redisPool)
+			return
+		}
 	}
 
-	if matched := regexp.MustCompile("^/sessions/(.+)$").FindStringSubmatch(path); matched != nil {
+	if matched := regexp.MustCompile("^/sessions/([^/]+)$").FindStringSubmatch(path); matched != nil {
 		if r.Method == "DELETE" {
 			if verbose {
 				log.Println("[MASTER] request dispatched")
@@ -717,9 +1913,23 @@ func restHandler(path string, w http.ResponseWriter, r *http.Request, redisPool
 			restDeleteSession(w, r, redisPool, matched[1])
 			return
 		}
+		if r.Method == "GET" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restGetSession(w, r, redisPool, matched[1])
+			return
+		}
+		if r.Method == "PUT" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restEditSession(w, r, redisPool, matched[1])
+			return
+		}
 	}
 
-	if matched := regexp.MustCompile("^/sessions/(.+)/resources/(.+)$").FindStringSubmatch(path); matched != nil {
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/resources/(.+)$").FindStringSubmatch(path); matched != nil {
 		if r.Method == "PUT" {
 			if verbose {
 				log.Println("[MASTER] request dispatched")
@@ -727,19 +1937,91 @@ func restHandler(path string, w http.ResponseWriter, r *http.Request, redisPool
 			restEditResource(w, r, redisPool, matched[1], matched[2])
 			return
 		}
+		if r.Method == "PATCH" {
+			if verbose {
+				log.Println("[MASTER] patch request dispatched")
+			}
+			restPatchResource(w, r, redisPool, matched[1], matched[2])
+			return
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restGetResource(w, r, redisPool, matched[1], matched[2])
+			return
+		}
+		if r.Method == "DELETE" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restDeleteResource(w, r, redisPool, matched[1], matched[2])
+			return
+		}
 	}
 
-	if matched := regexp.MustCompile("^/sessions/(.+)/resource$").FindStringSubmatch(path); matched != nil {
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/resource$").FindStringSubmatch(path); matched != nil {
 		if r.Method == "PATCH" {
 			if verbose {
 				log.Println("[MASTER] patch request dispatched")
 			}
-			restPatchResource(w, r, redisPool, matched[1])
+			m, _ := url.ParseQuery(r.URL.RawQuery)
+			restPatchResource(w, r, redisPool, matched[1], m.Get("name"))
+			return
+		}
+	}
+
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/export$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "GET" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restExportSession(w, r, redisPool, matched[1])
+			return
+		}
+	}
+
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/archive$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "POST" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restUploadArchive(w, r, redisPool, matched[1])
+			return
+		}
+	}
+
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/uploads$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "POST" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restNewUpload(w, r, redisPool, matched[1])
+			return
+		}
+	}
+
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/uploads/([^/]+)$").FindStringSubmatch(path); matched != nil {
+		if verbose {
+			log.Println("[MASTER] upload request dispatched")
+		}
+		switch r.Method {
+		case "GET":
+			restGetUpload(w, r, redisPool, matched[1], matched[2])
+			return
+		case "PUT":
+			restAppendUpload(w, r, redisPool, matched[1], matched[2])
+			return
+		case "POST":
+			restCompleteUpload(w, r, redisPool, matched[1], matched[2])
+			return
+		case "DELETE":
+			restDeleteUpload(w, r, redisPool, matched[1], matched[2])
 			return
 		}
 	}
 
-	if matched := regexp.MustCompile("^/sessions/(.+)/renders").FindStringSubmatch(path); matched != nil {
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/renders$").FindStringSubmatch(path); matched != nil {
 		if r.Method == "POST" {
 			if verbose {
 				log.Println("[MASTER] request dispatched")
@@ -756,11 +2038,103 @@ func restHandler(path string, w http.ResponseWriter, r *http.Request, redisPool
 
 			renderTimes = imin(imax(renderTimes, 1), 256)
 
+			tileCols, tileRows := 1, 1
+			if m["tiles"] != nil {
+				size := strings.Split(m["tiles"][0], "x")
+				if len(size) == 2 {
+					cols, errCols := strconv.Atoi(size[0])
+					rows, errRows := strconv.Atoi(size[1])
+					if errCols == nil && errRows == nil {
+						tileCols = imin(imax(cols, 1), 16)
+						tileRows = imin(imax(rows, 1), 16)
+					}
+				}
+			}
+
+			adaptive := AdaptiveSampling{MaxSamples: 256}
+			if m["noise"] != nil {
+				noise, err := strconv.ParseFloat(m["noise"][0], 64)
+				if err == nil && noise > 0 {
+					adaptive.Noise = noise
+				}
+			}
+			if m["maxSamples"] != nil {
+				n, err := strconv.Atoi(m["maxSamples"][0])
+				if err == nil {
+					adaptive.MaxSamples = imin(imax(n, renderTimes), 4096)
+				}
+			}
+			if m["budget"] != nil {
+				n, err := strconv.Atoi(m["budget"][0])
+				if err == nil && n >= 0 {
+					adaptive.Budget = n
+				}
+			}
+
+			async := m.Get("async") == "1"
+
+			timeout := -1
+			if m["timeout"] != nil {
+				n, err := strconv.Atoi(m["timeout"][0])
+				if err == nil && n >= 0 {
+					timeout = n
+				}
+			}
+
+			format, err := negotiateImageFormat(r)
+			if err != nil || (isHdrFormat(format) && !getConfig().supportsFloatImage()) {
+				writeUnsupportedFormat(w)
+				return
+			}
+
+			if tileCols*tileRows > 1 && !getConfig().supportsTiles() {
+				writeStatus(w, "UnsupportedTiles")
+				return
+			}
+
+			if verbose {
+				log.Printf("[MASTER] renderTimes = %d, tiles = %dx%d, adaptive = %+v, async = %v, timeout = %d, format = %s\n",
+					renderTimes, tileCols, tileRows, adaptive, async, timeout, format.Name)
+			}
+
+			restNewRender(w, r, requestChan, renders, matched[1], renderTimes, tileCols, tileRows, adaptive, async, timeout, format)
+			return
+		}
+	}
+
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/renders/([^/]+)$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "GET" {
+			if verbose {
+				log.Println("[MASTER] request dispatched")
+			}
+			restGetRender(w, r, renders, matched[1], matched[2])
+			return
+		}
+		if r.Method == "DELETE" {
+			if verbose {
+				log.Println("[MASTER] cancel request dispatched")
+			}
+			restCancelRender(w, r, renders, matched[1], matched[2])
+			return
+		}
+	}
+
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/renders/([^/]+)/image$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "GET" {
 			if verbose {
-				log.Printf("[MASTER] renderTimes = %d\n", renderTimes)
+				log.Println("[MASTER] request dispatched")
 			}
+			restGetRenderImage(w, r, renders, matched[1], matched[2])
+			return
+		}
+	}
 
-			restNewRender(w, r, requestChan, matched[1], renderTimes)
+	if matched := regexp.MustCompile("^/sessions/([^/]+)/renders/([^/]+)/stream$").FindStringSubmatch(path); matched != nil {
+		if r.Method == "GET" {
+			if verbose {
+				log.Println("[MASTER] stream request dispatched")
+			}
+			restStreamRender(w, r, renders, matched[1], matched[2])
 			return
 		}
 	}
@@ -778,11 +2152,25 @@ type Resource struct {
 	Hash string
 }
 
+// Tile is the region X, Y of the frame split into Cols x Rows.
+type Tile struct {
+	X    int
+	Y    int
+	Cols int
+	Rows int
+}
+
 type Message struct {
-	RenderId  string
-	SessionId string
-	InputJson string
-	Resources []Resource
+	RenderId    string
+	SessionId   string
+	InputJson   string
+	Resources   []Resource
+	Attempt     int
+	MaxAttempts int
+	Timeout     int   // seconds
+	FloatImage  bool  // publish a PFM image to render_float_image:<id> besides the JPEG
+	Quality     int   `json:",omitempty"` // quality of the JPEG; 0 for the default of the worker
+	Tile        *Tile `json:",omitempty"` // render only this region; nil for the whole frame
 }
 
 type LteAck struct {
@@ -792,9 +2180,18 @@ type LteAck struct {
 }
 
 type Result struct {
-	Err   error
-	Ack   []byte
-	Image []byte
+	Err        error
+	Ack        []byte
+	Image      []byte // JPEG, or PNG if the worker has no float image for FloatImage
+	FloatImage []byte // PFM
+	Samples    int    // samples per pixel of Image or FloatImage from "samples" of render_image; 0 if the renderer omits it
+	Offset     image.Point
+	Started    bool
+	Cancelled  bool
+	SampleId   string
+	Dispatched *Sample
+	// DispatchFailed is set with Err when the sample could not be pushed to render-queue.
+	DispatchFailed bool
 }
 
 type ResultReceiver struct {
@@ -803,8 +2200,30 @@ type ResultReceiver struct {
 	BeginTime  time.Time
 }
 
+// send passes the result to the render without blocking receiveRenderResult, which serves all renders.
+// The channel has room for every result of a running render, so the result is dropped only if the render
+// has finished and no longer reads it.
+func (receiver ResultReceiver) send(result Result) {
+	select {
+	case receiver.ResultChan <- result:
+	default:
+		log.Printf("[MASTER] dropped a result of sample %s\n", receiver.RenderId)
+	}
+}
+
+// AdaptiveSampling is the stopping condition of adaptive sampling given to a new render.
+type AdaptiveSampling struct {
+	Noise      float64 // target relative error; 0 disables adaptive sampling
+	MaxSamples int     // samples per pixel of each tile
+	Budget     int     // seconds
+}
+
 type RenderRequest struct {
 	SessionId  string
+	Timeout    int
+	FloatImage bool
+	Quality    int
+	Tile       *Tile
 	ResultChan chan Result
 }
 
@@ -864,98 +2283,162 @@ func receiveRenderResult(receiver chan ResultReceiver, waitingDuration chan time
 
 				resultReceivers[receiver.RenderId] = receiver
 
-			case "Ok":
-				imageDataResp, err := conn.Do("GET", "render_image:"+receiver.RenderId)
-				if err != nil {
-					receiver.ResultChan <- Result{Err: err}
-					continue
-				}
+				receiver.send(Result{Started: true, SampleId: receiver.RenderId})
 
-				_, err = conn.Do("DEL", "render_image:"+receiver.RenderId)
+			case "Ok":
+				conn.Send("MULTI")
+				conn.Send("GET", "render_image:"+receiver.RenderId)
+				conn.Send("GET", "render_float_image:"+receiver.RenderId)
+				conn.Send("DEL", "render_image:"+receiver.RenderId, "render_float_image:"+receiver.RenderId)
+				imageResp, err := conn.Do("EXEC")
 				if err != nil {
-					receiver.ResultChan <- Result{Err: err}
+					receiver.send(Result{Err: err, SampleId: receiver.RenderId})
 					continue
 				}
 
+				// the renderer reports the samples per pixel it actually rendered, which weights the sample on accumulation,
+				// and the position of the crop window for tiles; samples is 0 if omitted, e.g. by older LTE, and weighted as 1
 				var imageDataJson struct {
 					JpegData string `json:"jpegdata"`
+					Samples  int    `json:"samples"`
+					X        int    `json:"x"`
+					Y        int    `json:"y"`
+				}
+
+				if imageDataResp := imageResp.([]interface{})[0]; imageDataResp != nil {
+					if err := json.Unmarshal(imageDataResp.([]byte), &imageDataJson); err != nil {
+						receiver.send(Result{Err: err, SampleId: receiver.RenderId})
+						continue
+					}
 				}
 
-				if err := json.Unmarshal(imageDataResp.([]byte), &imageDataJson); err != nil {
-					receiver.ResultChan <- Result{Err: err}
+				if floatImage := imageResp.([]interface{})[1]; floatImage != nil {
+					receiver.send(Result{FloatImage: floatImage.([]byte), Samples: imageDataJson.Samples,
+						Offset: image.Pt(imageDataJson.X, imageDataJson.Y), SampleId: receiver.RenderId})
+					continue
+				}
+
+				if imageDataJson.JpegData == "" {
+					receiver.send(Result{Err: errors.New("render_image not found"), SampleId: receiver.RenderId})
 					continue
 				}
 
 				imageData, err := base64.StdEncoding.DecodeString(imageDataJson.JpegData)
 				if err != nil {
-					receiver.ResultChan <- Result{Err: err}
+					receiver.send(Result{Err: err, SampleId: receiver.RenderId})
 					continue
 				}
 
-				receiver.ResultChan <- Result{Image: imageData}
+				receiver.send(Result{Image: imageData, Samples: imageDataJson.Samples,
+					Offset: image.Pt(imageDataJson.X, imageDataJson.Y), SampleId: receiver.RenderId})
+
+			case "LinkError", "Failed", "Timeout":
+				receiver.send(Result{Ack: lteAckBytes, SampleId: receiver.RenderId})
 
-			case "LinkError":
-				receiver.ResultChan <- Result{Ack: lteAckBytes}
+			case "Cancelled":
+				receiver.send(Result{Cancelled: true, SampleId: receiver.RenderId})
 
 			default:
-				receiver.ResultChan <- Result{Err: errors.New("unknown lte-ack status: " + lteAck.Status)}
+				receiver.send(Result{Err: errors.New("unknown lte-ack status: " + lteAck.Status), SampleId: receiver.RenderId})
 			}
 
 		}
 	}
 }
-func dispatchRenderRequest(request *RenderRequest, conn redis.Conn) (string, error) {
-
-	conn.Send("MULTI")
-	conn.Send("GET", "session:"+request.SessionId+":input-json")
-	conn.Send("SMEMBERS", "session:"+request.SessionId+":resource")
-	conn.Send("SET", "session:"+request.SessionId+":modified", strconv.FormatInt(time.Now().Unix(), 10))
-	redisResp, err := conn.Do("EXEC")
+func dispatchRenderRequest(request *RenderRequest, conn redis.Conn) (*Sample, error) {
+	message, err := referenceSessionResources(request, conn)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if redisResp == nil {
-		return "", errors.New("result nil")
+	marshaled, err := json.Marshal(message)
+	if err != nil {
+		releaseResources(message.Resources, conn)
+		return nil, err
 	}
 
-	if redisResp.([]interface{})[0] == nil {
-		return "", errors.New("input-json nil; might be deleted session")
+	// workers pop from the right
+	if _, err := conn.Do("LPUSH", "render-queue", marshaled); err != nil {
+		releaseResources(message.Resources, conn)
+		return nil, err
 	}
 
-	message := Message{
-		RenderId:  strconv.FormatInt(time.Now().UnixNano(), 10),
-		SessionId: request.SessionId,
-		InputJson: string(redisResp.([]interface{})[0].([]byte))}
+	return &Sample{Message: *message, Marshaled: marshaled}, nil
+}
 
-	for _, resourceNameBytes := range redisResp.([]interface{})[1].([]interface{}) {
-		resourceName := string(resourceNameBytes.([]byte))
-		if resp, err := conn.Do("GET", "session:"+request.SessionId+":resource:"+resourceName); err != nil {
-			return "", err
-		} else {
-			resourceHash := string(resp.([]byte))
-			message.Resources = append(message.Resources, Resource{resourceName, resourceHash})
+// referenceSessionResources creates the message of a sample, taking a reference of every resource of the session for it.
+// The references are released when the message leaves render-queue or the in-flight list of the worker,
+// so that cancelling or replacing resources never deletes the blobs used by the sample.
+func referenceSessionResources(request *RenderRequest, conn redis.Conn) (*Message, error) {
+	for i := 0; i < 5; i++ {
+		// a resource referenced by the session is never being deleted, so the hashes are read under the watch
+		// instead of watching their counters
+		if _, err := conn.Do("WATCH", "session:"+request.SessionId+":input-json", "session:"+request.SessionId+":resource"); err != nil {
+			return nil, err
 		}
-	}
 
-	conn.Send("MULTI")
-	for _, resource := range message.Resources {
-		conn.Send("INCR", "resource:"+resource.Hash+":counter")
-	}
-	if _, err := conn.Do("EXEC"); err != nil {
-		return "", err
-	}
+		inputJson, err := conn.Do("GET", "session:"+request.SessionId+":input-json")
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+		if inputJson == nil {
+			conn.Do("UNWATCH")
+			return nil, errors.New("input-json nil; might be deleted session")
+		}
 
-	marshaled, err := json.Marshal(&message)
-	if err != nil {
-		return "", err
-	}
+		names, err := redis.Strings(conn.Do("SMEMBERS", "session:"+request.SessionId+":resource"))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
 
-	if _, err := conn.Do("RPUSH", "render-queue", marshaled); err != nil {
-		return "", err
+		message := &Message{
+			RenderId:    strconv.FormatInt(time.Now().UnixNano(), 10),
+			SessionId:   request.SessionId,
+			InputJson:   string(inputJson.([]byte)),
+			MaxAttempts: getConfig().RenderMaxAttempts,
+			Timeout:     request.Timeout,
+			FloatImage:  request.FloatImage,
+			Quality:     request.Quality,
+			Tile:        request.Tile}
+
+		for _, name := range names {
+			if _, err := conn.Do("WATCH", "session:"+request.SessionId+":resource:"+name); err != nil {
+				return nil, err
+			}
+			hash, err := getResourceHash(request.SessionId, name, conn)
+			if err != nil {
+				conn.Do("UNWATCH")
+				return nil, err
+			}
+			// deleted after SMEMBERS; EXEC fails since the set is watched
+			if hash == "" {
+				continue
+			}
+			message.Resources = append(message.Resources, Resource{name, hash})
+		}
+
+		conn.Send("MULTI")
+		for _, resource := range message.Resources {
+			conn.Send("INCR", "resource:"+resource.Hash+":counter")
+		}
+		conn.Send("SET", "session:"+request.SessionId+":modified", strconv.FormatInt(time.Now().Unix(), 10))
+		resp, err := conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if resp == nil {
+			if verbose {
+				log.Printf("[MASTER] retry referencing resources of session %s\n", request.SessionId)
+			}
+			continue
+		}
+
+		return message, nil
 	}
 
-	return message.RenderId, nil
+	return nil, errors.New("optimistic locking failed")
 }
 
 func interactWithRedis(requestChan chan RenderRequest, waitingDuration chan time.Duration, redisPool *redis.Pool) {
@@ -982,9 +2465,9 @@ func interactWithRedis(requestChan chan RenderRequest, waitingDuration chan time
 			log.Println("[MASTER] request received!")
 		}
 
-		renderId, err := dispatchRenderRequest(&request, conn)
+		sample, err := dispatchRenderRequest(&request, conn)
 		if err != nil {
-			request.ResultChan <- Result{Err: err}
+			request.ResultChan <- Result{Err: err, DispatchFailed: true}
 			continue
 		}
 
@@ -992,19 +2475,24 @@ func interactWithRedis(requestChan chan RenderRequest, waitingDuration chan time
 			log.Println("[MASTER] dispatched and result receiver set")
 		}
 
-		receiver <- ResultReceiver{RenderId: renderId, ResultChan: request.ResultChan, BeginTime: time.Now()}
+		receiver <- ResultReceiver{RenderId: sample.Message.RenderId, ResultChan: request.ResultChan, BeginTime: time.Now()}
+
+		request.ResultChan <- Result{Dispatched: sample}
 	}
 
 }
 
 func startRestServer(redisPool *redis.Pool, waitingDuration chan time.Duration) {
 	requestChan := make(chan RenderRequest, 256)
+	renders := newRenderTable(redisPool)
 
 	http.HandleFunc("/v0/", func(w http.ResponseWriter, r *http.Request) {
-		restHandler(strings.TrimPrefix(r.URL.Path, "/v0"), w, r, redisPool, waitingDuration, requestChan)
+		restHandler(strings.TrimPrefix(r.URL.Path, "/v0"), w, r, redisPool, waitingDuration, requestChan, renders)
 	})
 
 	go interactWithRedis(requestChan, waitingDuration, redisPool)
 
-	http.ListenAndServe(":80", nil)
+	go cleanupRenders(renders)
+
+	http.ListenAndServe(getConfig().HttpAddr, nil)
 }
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/lighttransport/francine/blobstore"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	uploadChunkSize = blobstore.ChunkSize
+	uploadTtl       = 24 * 60 * 60 // seconds
+)
+
+// Large resources are uploaded in pieces. While uploading, the chunks are appended to the file <UploadDir>/<id>
+// and the size and the state of SHA256 are kept in upload:<id>, so that an interrupted upload can be resumed from the last stored chunk.
+// The uploads of a session are listed in session:<id>:uploads to be removed with the session.
+// On completion, the file is streamed into the blob store.
+
+var (
+	uploadMutex sync.Mutex
+	busyUploads = make(map[string]bool)
+)
+
+// errUploadSessionDeleted is returned by commitUpload if the session is deleted during the upload.
+var errUploadSessionDeleted = errors.New("session of the upload is deleted")
+
+// lockUpload keeps other requests from writing the file of the upload. It returns false if another request is writing it.
+func lockUpload(uploadId string) bool {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+
+	if busyUploads[uploadId] {
+		return false
+	}
+	busyUploads[uploadId] = true
+	return true
+}
+
+func unlockUpload(uploadId string) {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+
+	delete(busyUploads, uploadId)
+}
+
+func uploadPath(uploadId string) string {
+	return filepath.Join(getConfig().UploadDir, uploadId)
+}
+
+func removeUploadFile(uploadId string) {
+	if err := os.Remove(uploadPath(uploadId)); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// cleanupUploads removes the files of the uploads expired or deleted with their sessions.
+func cleanupUploads(conn redis.Conn) {
+	files, err := ioutil.ReadDir(getConfig().UploadDir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, file := range files {
+		uploadId := file.Name()
+
+		exists, err := redis.Bool(conn.Do("EXISTS", "upload:"+uploadId))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if exists || !lockUpload(uploadId) {
+			continue
+		}
+
+		if verbose {
+			log.Printf("[MASTER] remove the file of upload %s\n", uploadId)
+		}
+		removeUploadFile(uploadId)
+		unlockUpload(uploadId)
+	}
+}
+
+type Upload struct {
+	Id        string
+	SessionId string
+	Name      string
+	Size      int64
+	hash      hash.Hash
+}
+
+func getUpload(uploadId string, conn redis.Conn) (*Upload, error) {
+	values, err := redis.Values(conn.Do("HMGET", "upload:"+uploadId, "session", "name", "size", "state"))
+	if err != nil {
+		return nil, err
+	}
+
+	if values[0] == nil {
+		return nil, nil
+	}
+
+	size, err := strconv.ParseInt(string(values[2].([]byte)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(values[3].([]byte)); err != nil {
+		return nil, err
+	}
+
+	return &Upload{
+		Id:        uploadId,
+		SessionId: string(values[0].([]byte)),
+		Name:      string(values[1].([]byte)),
+		Size:      size,
+		hash:      h}, nil
+}
+
+// findUpload writes UploadDoesNotExist unless the upload exists in the session.
+func findUpload(w http.ResponseWriter, conn redis.Conn, session, uploadId string) *Upload {
+	upload, err := getUpload(uploadId, conn)
+	if err != nil {
+		raiseHttpError(w, err)
+		return nil
+	}
+
+	if upload != nil && upload.SessionId == session {
+		return upload
+	}
+
+	writeUploadResult(w, &UploadResult{Status: "UploadDoesNotExist"})
+	return nil
+}
+
+type UploadResult struct {
+	Status   string
+	UploadId string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	Offset   int64
+	Hash     string `json:",omitempty"`
+}
+
+func writeUploadResult(w http.ResponseWriter, result *UploadResult) {
+	writeJson(w, http.StatusOK, result)
+}
+
+/**
+ * @api {post} /sessions/:sessionId/uploads Start chunked upload
+ * @apiVersion v0
+ * @apiName NewUpload
+ * @apiGroup Render
+ *
+ * @apiDescription Start a resumable upload of a resource which may be larger than memory.
+ * Send the data by AppendUpload, then finish it by CompleteUpload. Unfinished uploads expire in a day,
+ * and are removed with the session.
+ *
+ * @apiParam {String} Name Resource name.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "SessionDoesNotExist" if not, "InvalidResourceName" if Name is not a relative path.
+ * @apiSuccess {String} UploadId Upload ID.
+ * @apiSuccess {Number} Offset Bytes stored so far.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status"  : "Ok",
+ *       "UploadId": "0f3a5c9e7d2b4a6c8e1f3a5c7e9b2d4f",
+ *       "Name"    : "teapot.mesh",
+ *       "Offset"  : 0
+ *     }
+ *
+ */
+func restNewUpload(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	var requestJson struct {
+		Name string
+	}
+
+	if reqBody, err := ioutil.ReadAll(r.Body); err != nil {
+		raiseHttpError(w, err)
+		return
+	} else {
+		if err := json.Unmarshal(reqBody, &requestJson); err != nil {
+			raiseHttpError(w, err)
+			return
+		}
+	}
+
+	if !isValidResourceName(requestJson.Name) {
+		writeUploadResult(w, &UploadResult{Status: "InvalidResourceName", Name: requestJson.Name})
+		return
+	}
+
+	// the upload is not listed in a session being deleted
+	if _, err := conn.Do("WATCH", "session:"+session+":input-json"); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	e, err := doesSessionExist(session, conn)
+	if err != nil {
+		conn.Do("UNWATCH")
+		raiseHttpError(w, err)
+		return
+	}
+
+	if e == false {
+		conn.Do("UNWATCH")
+		writeUploadResult(w, &UploadResult{Status: "SessionDoesNotExist"})
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+	uploadId := hex.EncodeToString(idBytes)
+
+	state, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", "upload:"+uploadId, "session", session, "name", requestJson.Name, "size", 0, "state", state)
+	conn.Send("EXPIRE", "upload:"+uploadId, uploadTtl)
+	conn.Send("SADD", "session:"+session+":uploads", uploadId)
+	resp, err := conn.Do("EXEC")
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+	if resp == nil {
+		writeUploadResult(w, &UploadResult{Status: "SessionDoesNotExist"})
+		return
+	}
+
+	if verbose {
+		log.Printf("[MASTER] upload %s of resource %s started\n", uploadId, requestJson.Name)
+	}
+
+	writeUploadResult(w, &UploadResult{Status: "Ok", UploadId: uploadId, Name: requestJson.Name})
+}
+
+/**
+ * @api {get} /sessions/:sessionId/uploads/:uploadId Get upload offset
+ * @apiVersion v0
+ * @apiName GetUpload
+ * @apiGroup Render
+ *
+ * @apiDescription Get the number of bytes stored, from which an interrupted upload is resumed.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "UploadDoesNotExist" if not.
+ * @apiSuccess {Number} Offset Bytes stored so far.
+ *
+ */
+func restGetUpload(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, uploadId string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	upload := findUpload(w, conn, session, uploadId)
+	if upload == nil {
+		return
+	}
+
+	writeUploadResult(w, &UploadResult{Status: "Ok", UploadId: upload.Id, Name: upload.Name, Offset: upload.Size})
+}
+
+/**
+ * @api {put} /sessions/:sessionId/uploads/:uploadId Append to upload
+ * @apiVersion v0
+ * @apiName AppendUpload
+ * @apiGroup Render
+ *
+ * @apiDescription Append the body to the upload. The body is streamed and stored every 4MB,
+ * so if the request is interrupted, the upload is resumed from the Offset returned by GetUpload.
+ *
+ * @apiParam {Number} offset Offset of the body in the resource; must be equal to the bytes stored so far.
+ * @apiParam {binary} Input A part of the resource data.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "UploadDoesNotExist", "OffsetMismatch",
+ *                            or "UploadBusy" if another request is appending to or completing the upload.
+ * @apiSuccess {Number} Offset Bytes stored so far.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "Ok",
+ *       "Offset": 8388608
+ *     }
+ *
+ */
+func restAppendUpload(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, uploadId string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	// the upload is read after locking, since another request may be writing it
+	if !lockUpload(uploadId) {
+		writeUploadResult(w, &UploadResult{Status: "UploadBusy", UploadId: uploadId})
+		return
+	}
+	defer unlockUpload(uploadId)
+
+	upload := findUpload(w, conn, session, uploadId)
+	if upload == nil {
+		return
+	}
+
+	m, _ := url.ParseQuery(r.URL.RawQuery)
+	offset, err := strconv.ParseInt(m.Get("offset"), 10, 64)
+	if err != nil || offset != upload.Size {
+		writeUploadResult(w, &UploadResult{Status: "OffsetMismatch", UploadId: upload.Id, Offset: upload.Size})
+		return
+	}
+
+	file, err := os.OpenFile(uploadPath(upload.Id), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+	defer file.Close()
+
+	// the data after the stored size is left by an append interrupted before updating upload:<id>
+	if err := file.Truncate(upload.Size); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	chunk := make([]byte, uploadChunkSize)
+	for {
+		n, readErr := io.ReadFull(r.Body, chunk)
+		if n > 0 {
+			// the data is on the disk before the size is updated
+			if _, err := file.WriteAt(chunk[:n], upload.Size); err != nil {
+				raiseHttpError(w, err)
+				return
+			}
+			if err := file.Sync(); err != nil {
+				raiseHttpError(w, err)
+				return
+			}
+
+			upload.hash.Write(chunk[:n])
+			state, err := upload.hash.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				raiseHttpError(w, err)
+				return
+			}
+
+			// the upload may be deleted meanwhile
+			if _, err := conn.Do("WATCH", "upload:"+uploadId); err != nil {
+				raiseHttpError(w, err)
+				return
+			}
+			size, err := redis.Int64(conn.Do("HGET", "upload:"+uploadId, "size"))
+			if err != nil || size != upload.Size {
+				conn.Do("UNWATCH")
+				writeUploadResult(w, &UploadResult{Status: "OffsetMismatch", UploadId: upload.Id, Offset: size})
+				return
+			}
+
+			conn.Send("MULTI")
+			conn.Send("HMSET", "upload:"+uploadId, "size", upload.Size+int64(n), "state", state)
+			conn.Send("EXPIRE", "upload:"+uploadId, uploadTtl)
+			resp, err := conn.Do("EXEC")
+			if err != nil {
+				raiseHttpError(w, err)
+				return
+			}
+			if resp == nil {
+				writeUploadResult(w, &UploadResult{Status: "OffsetMismatch", UploadId: upload.Id, Offset: upload.Size})
+				return
+			}
+
+			upload.Size += int64(n)
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			log.Printf("[MASTER] upload %s interrupted at %d bytes: %s\n", uploadId, upload.Size, readErr.Error())
+			break
+		}
+	}
+
+	writeUploadResult(w, &UploadResult{Status: "Ok", UploadId: upload.Id, Offset: upload.Size})
+}
+
+/**
+ * @api {post} /sessions/:sessionId/uploads/:uploadId Complete upload
+ * @apiVersion v0
+ * @apiName CompleteUpload
+ * @apiGroup Render
+ *
+ * @apiDescription Save the uploaded data as the resource, like EditResource does.
+ *
+ * @apiHeader {String} [X-Content-SHA256] Expected SHA256 hash value of the whole data.
+ *
+ * @apiSuccess {String} Status "Ok" if success, "UploadDoesNotExist", "HashMismatch", "UploadBusy",
+ *                            or "SessionDoesNotExist" if the session is deleted.
+ * @apiSuccess {String} Name Filename of resource data.
+ * @apiSuccess {String} Hash SHA256 hash value of resource data.
+ * @apiSuccess {Number} Offset Size of resource data in bytes.
+ *
+ * @apiSuccessExample Success-Response:
+ *     HTTP/1.1 200 OK
+ *     {
+ *       "Status": "Ok",
+ *       "Name"  : "teapot.mesh",
+ *       "Hash"  : "5968ad5c2a58c6ef057fb16387b4f02c0c297559043ed54e68432fffd01eb540",
+ *       "Offset": 3221225472
+ *     }
+ *
+ */
+func restCompleteUpload(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, uploadId string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if !lockUpload(uploadId) {
+		writeUploadResult(w, &UploadResult{Status: "UploadBusy", UploadId: uploadId})
+		return
+	}
+	defer unlockUpload(uploadId)
+
+	upload := findUpload(w, conn, session, uploadId)
+	if upload == nil {
+		return
+	}
+
+	hash := hex.EncodeToString(upload.hash.Sum(nil))
+
+	if expected := strings.ToLower(r.Header.Get("X-Content-SHA256")); expected != "" && expected != hash {
+		writeUploadResult(w, &UploadResult{Status: "HashMismatch", UploadId: upload.Id, Name: upload.Name, Offset: upload.Size, Hash: hash})
+		return
+	}
+
+	err := commitUpload(upload, hash, conn)
+	if err == errUploadSessionDeleted {
+		writeUploadResult(w, &UploadResult{Status: "SessionDoesNotExist"})
+		return
+	}
+	if err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	if verbose {
+		log.Printf("[MASTER] upload %s completed as resource %s (%s)\n", uploadId, upload.Name, hash)
+	}
+
+	writeUploadResult(w, &UploadResult{Status: "Ok", Name: upload.Name, Offset: upload.Size, Hash: hash})
+}
+
+// commitUpload streams the file of the upload into the blob store unless the blob is already stored,
+// and attaches the blob to the session. The upload must be locked by lockUpload.
+func commitUpload(upload *Upload, hash string, conn redis.Conn) error {
+	session := upload.SessionId
+
+	_, err := referenceBlob(session, upload.Name, hash, func() error {
+		return putUploadFile(upload, hash)
+	}, func() error {
+		if _, err := conn.Do("WATCH", "upload:"+upload.Id, "session:"+session+":input-json"); err != nil {
+			return err
+		}
+
+		uploading, err := redis.Bool(conn.Do("EXISTS", "upload:"+upload.Id))
+		if err != nil {
+			return err
+		}
+		if !uploading {
+			return errors.New("upload " + upload.Id + " is already completed")
+		}
+
+		e, err := doesSessionExist(session, conn)
+		if err != nil {
+			return err
+		}
+		if !e {
+			return errUploadSessionDeleted
+		}
+		return nil
+	}, func() {
+		conn.Send("DEL", "upload:"+upload.Id)
+		conn.Send("SREM", "session:"+session+":uploads", upload.Id)
+	}, conn)
+	if err != nil {
+		return err
+	}
+
+	removeUploadFile(upload.Id)
+
+	return nil
+}
+
+func putUploadFile(upload *Upload, hash string) error {
+	// no file is created by an upload without data
+	if upload.Size == 0 {
+		return blobStore.Put(hash, strings.NewReader(""), 0)
+	}
+
+	file, err := os.Open(uploadPath(upload.Id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return blobStore.Put(hash, file, upload.Size)
+}
+
+/**
+ * @api {delete} /sessions/:sessionId/uploads/:uploadId Abort upload
+ * @apiVersion v0
+ * @apiName DeleteUpload
+ * @apiGroup Render
+ *
+ * @apiSuccess {String} Status "Ok" if success, "UploadDoesNotExist" if not.
+ *
+ */
+func restDeleteUpload(w http.ResponseWriter, r *http.Request, redisPool *redis.Pool, session, uploadId string) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	upload := findUpload(w, conn, session, uploadId)
+	if upload == nil {
+		return
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", "upload:"+uploadId)
+	conn.Send("SREM", "session:"+session+":uploads", uploadId)
+	if _, err := conn.Do("EXEC"); err != nil {
+		raiseHttpError(w, err)
+		return
+	}
+
+	// the file is left to cleanupUploads if a request is writing it
+	if lockUpload(uploadId) {
+		removeUploadFile(uploadId)
+		unlockUpload(uploadId)
+	}
+
+	writeUploadResult(w, &UploadResult{Status: "Ok", UploadId: upload.Id, Offset: upload.Size})
+}
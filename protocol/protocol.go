@@ -0,0 +1,112 @@
+// Package protocol holds what the master and the workers share about the messages they exchange through Redis.
+package protocol
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"strconv"
+)
+
+// CacheStats is the state of the resource cache of a worker, which is reported to the master with pings.
+type CacheStats struct {
+	Bytes     int64 // total size of the cached resources
+	Limit     int64 // 0 for no limit
+	Files     int
+	Pinned    int // resources used by the running render
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// inflightMessage is the part of a render message in render-queue and render-inflight:<worker> read here.
+// The other fields of the message are kept as they are on requeueing.
+type inflightMessage struct {
+	RenderId    string
+	Attempt     int
+	MaxAttempts int
+	Resources   []struct {
+		Hash string
+	}
+}
+
+// nextAttempt parses a message left in an in-flight list, and returns it with Attempt incremented
+// as well as the message to push back to render-queue.
+func nextAttempt(msgBytes []byte) (*inflightMessage, []byte, error) {
+	var message inflightMessage
+	if err := json.Unmarshal(msgBytes, &message); err != nil {
+		return nil, nil, err
+	}
+	message.Attempt++
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msgBytes, &fields); err != nil {
+		return nil, nil, err
+	}
+	fields["Attempt"] = json.RawMessage(strconv.Itoa(message.Attempt))
+
+	marshaled, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &message, marshaled, nil
+}
+
+// RequeueInflightRenders moves messages left in the in-flight list back to render-queue,
+// or fails them when they have been tried MaxAttempts times. The references of the resources of a failed render
+// are released by release, while those of a requeued one go with the message.
+// logPrefix is the tag of the log messages, e.g. "[MASTER]".
+func RequeueInflightRenders(inflightName string, conn redis.Conn, logPrefix string, release func(hashes []string)) error {
+	for {
+		if _, err := conn.Do("WATCH", inflightName); err != nil {
+			return err
+		}
+
+		msgBytes, err := conn.Do("LINDEX", inflightName, -1)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if msgBytes == nil {
+			conn.Do("UNWATCH")
+			return nil
+		}
+
+		message, requeued, err := nextAttempt(msgBytes.([]byte))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		failed := message.MaxAttempts > 0 && message.Attempt >= message.MaxAttempts
+
+		conn.Send("MULTI")
+		conn.Send("RPOP", inflightName)
+		if failed {
+			log.Printf("%s render %s failed %d times; giving up\n", logPrefix, message.RenderId, message.Attempt)
+			ack, _ := json.Marshal(map[string]string{"RenderId": message.RenderId, "Status": "Failed",
+				"Log": "render failed after " + strconv.Itoa(message.Attempt) + " attempts"})
+			conn.Send("RPUSH", "lte-ack", ack)
+		} else {
+			log.Printf("%s requeueing render %s\n", logPrefix, message.RenderId)
+			// workers pop from the right, so the message goes to the head of the queue
+			conn.Send("RPUSH", "render-queue", requeued)
+		}
+		resp, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			// the list has been modified; retry
+			continue
+		}
+
+		if failed {
+			hashes := make([]string, 0, len(message.Resources))
+			for _, resource := range message.Resources {
+				hashes = append(hashes, resource.Hash)
+			}
+			release(hashes)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNextAttempt(t *testing.T) {
+	msgBytes := []byte(`{"RenderId":"r1","SessionId":"s1","Resources":[{"Name":"a.obj","Hash":"h1"}],` +
+		`"Attempt":1,"MaxAttempts":3,"Timeout":60,"Tile":{"X":1,"Y":0,"Cols":2,"Rows":1}}`)
+
+	message, requeued, err := nextAttempt(msgBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.RenderId != "r1" || message.Attempt != 2 || message.MaxAttempts != 3 {
+		t.Errorf("message = %+v", message)
+	}
+	if len(message.Resources) != 1 || message.Resources[0].Hash != "h1" {
+		t.Errorf("resources = %+v", message.Resources)
+	}
+
+	// the fields unknown to this package survive
+	var got, want map[string]interface{}
+	if err := json.Unmarshal(requeued, &got); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(msgBytes, &want)
+	want["Attempt"] = float64(2)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requeued = %v, want %v", got, want)
+	}
+
+	// a message without Attempt is on its first attempt
+	if message, requeued, err := nextAttempt([]byte(`{"RenderId":"r2"}`)); err != nil {
+		t.Fatal(err)
+	} else if message.Attempt != 1 || string(requeued) != `{"Attempt":1,"RenderId":"r2"}` {
+		t.Errorf("message = %+v, requeued = %s", message, requeued)
+	}
+
+	if _, _, err := nextAttempt([]byte("not json")); err == nil {
+		t.Error("nextAttempt of a broken message succeeded")
+	}
+}
@@ -18,7 +18,7 @@ ABS_DIR=`dirname $ABS_SH`
 sudo -E rm -rf $ABS_DIR/docker_dist
 mkdir $ABS_DIR/docker_dist
 
-sudo -E docker run -v $LTE_DIR:/tmp/lte -v $ABS_DIR:/tmp/worker -v $ABS_DIR/docker_dist:/tmp/docker_dist lighttransport/lte_builder /tmp/internal.sh $LTE_VERSION
+sudo -E docker run -v $LTE_DIR:/tmp/lte -v $ABS_DIR:/tmp/worker -v $ABS_DIR/../blobstore:/tmp/blobstore -v $ABS_DIR/../protocol:/tmp/protocol -v $ABS_DIR/docker_dist:/tmp/docker_dist lighttransport/lte_builder /tmp/internal.sh $LTE_VERSION
 
 sudo -E cp internal_dockerfile $ABS_DIR/docker_dist/Dockerfile
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"github.com/lighttransport/francine/blobstore"
+	"github.com/lighttransport/francine/protocol"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	hash    string
+	size    int64
+	pins    int
+	element *list.Element
+}
+
+// ResourceCache manages the resource files in tmpPrefix/resources named by their hashes.
+// Files are evicted in least recently used order when the total size exceeds the limit,
+// except pinned ones which are symlinked from a running render.
+type ResourceCache struct {
+	mutex   sync.Mutex
+	dir     string
+	limit   int64
+	entries map[string]*cacheEntry
+	lru     *list.List // of *cacheEntry; the front is the most recently used
+	stats   protocol.CacheStats
+}
+
+// newResourceCache creates the cache with files left in dir by the previous run of the worker.
+func newResourceCache(dir string, limit int64) (*ResourceCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// older files are evicted first
+	sort.Sort(byModTime(files))
+
+	cache := &ResourceCache{
+		dir:     dir,
+		limit:   limit,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+	cache.stats.Limit = limit
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || !blobstore.IsValidHash(file.Name()) {
+			continue
+		}
+		entry := &cacheEntry{hash: file.Name(), size: file.Size()}
+		entry.element = cache.lru.PushBack(entry)
+		cache.entries[entry.hash] = entry
+		cache.stats.Bytes += entry.size
+	}
+
+	return cache, nil
+}
+
+// byModTime sorts files from the newest.
+type byModTime []os.FileInfo
+
+func (files byModTime) Len() int           { return len(files) }
+func (files byModTime) Swap(i, j int)      { files[i], files[j] = files[j], files[i] }
+func (files byModTime) Less(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) }
+
+// resourceCache holds the resources of this worker. Its limit is CACHE_SIZE in bytes, or unlimited if it is not set.
+var resourceCache *ResourceCache
+
+func (cache *ResourceCache) path(hash string) string {
+	return cache.dir + "/" + hash
+}
+
+// acquire pins the resource and returns its path. If it is not cached, download writes it to the path.
+// The resource must be released after use.
+func (cache *ResourceCache) acquire(hash string, download func(path string) error) (string, error) {
+	cache.mutex.Lock()
+	if entry, ok := cache.entries[hash]; ok {
+		entry.pins++
+		cache.lru.MoveToFront(entry.element)
+		cache.stats.Hits++
+		cache.mutex.Unlock()
+
+		// keep the order across restarts
+		now := time.Now()
+		os.Chtimes(cache.path(hash), now, now)
+		return cache.path(hash), nil
+	}
+	cache.stats.Misses++
+	cache.mutex.Unlock()
+
+	path := cache.path(hash)
+	if err := download(path); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[hash]
+	if ok {
+		cache.lru.MoveToFront(entry.element)
+	} else {
+		entry = &cacheEntry{hash: hash, size: info.Size()}
+		entry.element = cache.lru.PushFront(entry)
+		cache.entries[hash] = entry
+		cache.stats.Bytes += entry.size
+	}
+	entry.pins++
+
+	return path, nil
+}
+
+func (cache *ResourceCache) release(hash string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if entry, ok := cache.entries[hash]; ok && entry.pins > 0 {
+		entry.pins--
+	}
+}
+
+// evict removes least recently used resources until the total size fits in the limit, and returns their hashes.
+func (cache *ResourceCache) evict() []string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.limit <= 0 {
+		return nil
+	}
+
+	var evicted []string
+	for element := cache.lru.Back(); element != nil && cache.stats.Bytes > cache.limit; {
+		entry := element.Value.(*cacheEntry)
+		element = element.Prev()
+		if entry.pins > 0 {
+			continue
+		}
+		if err := cache.removeEntry(entry); err != nil {
+			log.Println(err)
+			continue
+		}
+		cache.stats.Evictions++
+		evicted = append(evicted, entry.hash)
+	}
+
+	if cache.stats.Bytes > cache.limit {
+		log.Printf("[WORKER] resource cache holds %d bytes over the limit %d; all the rest are in use\n", cache.stats.Bytes, cache.limit)
+	}
+
+	return evicted
+}
+
+// remove removes the resource unless it is pinned, and reports whether it has been removed.
+func (cache *ResourceCache) remove(hash string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[hash]
+	if !ok || entry.pins > 0 {
+		return false
+	}
+	if err := cache.removeEntry(entry); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+func (cache *ResourceCache) removeEntry(entry *cacheEntry) error {
+	if err := os.Remove(cache.path(entry.hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cache.lru.Remove(entry.element)
+	delete(cache.entries, entry.hash)
+	cache.stats.Bytes -= entry.size
+	return nil
+}
+
+// hashes returns the hashes of all the cached resources.
+func (cache *ResourceCache) hashes() []string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	hashes := make([]string, 0, cache.lru.Len())
+	for element := cache.lru.Front(); element != nil; element = element.Next() {
+		hashes = append(hashes, element.Value.(*cacheEntry).hash)
+	}
+	return hashes
+}
+
+func (cache *ResourceCache) getStats() protocol.CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Files = cache.lru.Len()
+	for _, entry := range cache.entries {
+		if entry.pins > 0 {
+			stats.Pinned++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/lighttransport/francine/protocol"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestCache(t *testing.T, limit int64) (*ResourceCache, string) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newResourceCache(dir+"/resources", limit)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cache, dir
+}
+
+// acquireTest acquires the resource of the name, downloading 10 bytes if it is not cached.
+func acquireTest(t *testing.T, cache *ResourceCache, name string) {
+	_, err := cache.acquire(testHash(name), func(path string) error {
+		return ioutil.WriteFile(path, []byte("0123456789"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResourceCacheLru(t *testing.T) {
+	cache, dir := newTestCache(t, 25)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c"} {
+		acquireTest(t, cache, name)
+		cache.release(testHash(name))
+	}
+	// a is used again, so b is the least recently used
+	acquireTest(t, cache, "a")
+	cache.release(testHash("a"))
+
+	if got, want := cache.hashes(), []string{testHash("a"), testHash("c"), testHash("b")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hashes = %v, want %v", got, want)
+	}
+
+	if evicted := cache.evict(); !reflect.DeepEqual(evicted, []string{testHash("b")}) {
+		t.Errorf("evicted %v, want b", evicted)
+	}
+	if _, err := os.Stat(cache.path(testHash("b"))); !os.IsNotExist(err) {
+		t.Errorf("the file of the evicted resource remains: %v", err)
+	}
+
+	want := protocol.CacheStats{Bytes: 20, Limit: 25, Files: 2, Hits: 1, Misses: 3, Evictions: 1}
+	if stats := cache.getStats(); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestResourceCachePin(t *testing.T) {
+	cache, dir := newTestCache(t, 15)
+	defer os.RemoveAll(dir)
+
+	// a is pinned by a running render while b is not
+	acquireTest(t, cache, "a")
+	acquireTest(t, cache, "b")
+	cache.release(testHash("b"))
+
+	if evicted := cache.evict(); !reflect.DeepEqual(evicted, []string{testHash("b")}) {
+		t.Errorf("evicted %v, want b", evicted)
+	}
+	if stats := cache.getStats(); stats.Pinned != 1 || stats.Files != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// the pinned resource is kept even over the limit
+	acquireTest(t, cache, "c")
+	if evicted := cache.evict(); evicted != nil {
+		t.Errorf("evicted %v of pinned resources", evicted)
+	}
+	if cache.remove(testHash("a")) {
+		t.Error("removed the pinned resource")
+	}
+
+	cache.release(testHash("a"))
+	cache.release(testHash("c"))
+	if !cache.remove(testHash("a")) {
+		t.Error("failed to remove the released resource")
+	}
+	if evicted := cache.evict(); evicted != nil {
+		t.Errorf("evicted %v under the limit", evicted)
+	}
+}
+
+func TestResourceCacheUnlimited(t *testing.T) {
+	cache, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c"} {
+		acquireTest(t, cache, name)
+		cache.release(testHash(name))
+	}
+	if evicted := cache.evict(); evicted != nil {
+		t.Errorf("evicted %v without a limit", evicted)
+	}
+}
+
+func TestResourceCacheReload(t *testing.T) {
+	cache, dir := newTestCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	// the files left by the previous run are ordered by their modification times
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		path := cache.path(testHash(name))
+		if err := ioutil.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, modTime, modTime)
+	}
+	// files not named by hashes are not resources
+	ioutil.WriteFile(cache.dir+"/partial", []byte("0"), 0644)
+
+	reloaded, err := newResourceCache(cache.dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reloaded.hashes(), []string{testHash("c"), testHash("b"), testHash("a")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hashes = %v, want %v", got, want)
+	}
+	if evicted := reloaded.evict(); !reflect.DeepEqual(evicted, []string{testHash("a")}) {
+		t.Errorf("evicted %v, want the oldest a", evicted)
+	}
+}
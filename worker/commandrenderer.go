@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CommandRenderer runs another renderer CLI given by RENDERER_COMMAND, e.g.
+// "/usr/bin/pbrt --seed {seed} --outfile {output} {input}".
+// The command is split by spaces, and these placeholders in each argument are replaced:
+// {input} is the scene file, {dir} the render directory, {output} the image file to write in PNG or JPEG,
+// {float_output} the PFM file to write if a float image is wanted, {seed} the random seed, {render_id} the sample ID,
+// and {crop} the normalized crop window "x0,y0,x1,y1" of the tile.
+// The images must be of the whole frame, and the worker cuts out the tile. The render fails if the command exits with an error.
+type CommandRenderer struct {
+	command []string
+}
+
+func newCommandRenderer(command string) (*CommandRenderer, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("please set RENDERER_COMMAND")
+	}
+
+	return &CommandRenderer{command: fields}, nil
+}
+
+func (renderer *CommandRenderer) Render(job *RenderJob, running *RunningRender) (*RenderOutput, error) {
+	outputPath := job.Dir + "/render_output.png"
+	floatPath := job.Dir + "/render_output.pfm"
+
+	crop := "0,0,1,1"
+	if job.Tile != nil {
+		crop = job.Tile.cropWindow()
+	}
+
+	replacer := strings.NewReplacer(
+		"{input}", job.Dir+"/"+job.InputJson,
+		"{dir}", job.Dir,
+		"{output}", outputPath,
+		"{float_output}", floatPath,
+		"{seed}", strconv.Itoa(job.Seed),
+		"{render_id}", job.RenderId,
+		"{crop}", crop)
+	args := make([]string, 0, len(renderer.command)-1)
+	for _, arg := range renderer.command[1:] {
+		args = append(args, replacer.Replace(arg))
+	}
+
+	output := &RenderOutput{}
+	var err error
+	output.Log, err = runRendererCommand(sandbox.command(renderer.command[0], args, job.Dir), running)
+	if err != nil {
+		return output, err
+	}
+
+	file, err := os.Open(outputPath)
+	if err != nil {
+		return output, err
+	}
+	img, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return output, err
+	}
+
+	bounds := img.Bounds()
+	rect := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+	if job.Tile != nil {
+		rect = job.Tile.rect(bounds.Size())
+	}
+
+	output.Offset = rect.Min
+
+	if job.FloatImage {
+		// the master falls back to the lossless PNG in render_image if the renderer does not write it
+		if data, err := ioutil.ReadFile(floatPath); err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+		} else if output.FloatImage, err = cropPfm(data, rect); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// render_image carries the offset of the tile even if the float image is published
+	if job.FloatImage && output.FloatImage == nil {
+		output.Image, err = encodePng(img, rect.Add(bounds.Min))
+	} else {
+		output.Image, err = encodeJpeg(img, rect.Add(bounds.Min), job.Quality)
+	}
+	if err != nil {
+		return output, err
+	}
+
+	return output, nil
+}
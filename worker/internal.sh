@@ -5,6 +5,9 @@ version=$1
 cd tmp
 
 cp -R worker workspace/src
+mkdir -p workspace/src/github.com/lighttransport/francine
+cp -R blobstore workspace/src/github.com/lighttransport/francine
+cp -R protocol workspace/src/github.com/lighttransport/francine
 
 # copy LTE binary
 cp lte/lte_linux_x64.${version}.tar.bz2 .
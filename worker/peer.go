@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/lighttransport/francine/blobstore"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	peerTtl           = 3 * pingIntervalMin * 60 // seconds; a peer not advertising for this long is considered gone
+	peerFetchAttempts = 3                        // peers tried before falling back to the master or the blob store
+)
+
+// Workers serve their verified resources in tmpPrefix/resources to each other.
+// The workers which hold a blob are kept in the sorted set blob-peers:<hash> scored by the time of the last advertisement.
+// A worker fetches a blob from a random holder and then becomes a holder itself,
+// so the number of sources grows exponentially like a fan-out tree while the master serves only the first few.
+
+// peerUrl is the URL of the peer server of this worker, or "" if peer distribution is disabled.
+var peerUrl string
+
+// startPeerServer serves the resources on addr, e.g. ":7070", or "127.0.0.1:0" to run many workers on one host.
+// The advertised host is PEER_HOST, or the hostname if addr does not have a specific host.
+func startPeerServer(addr string, redisPool *redis.Pool) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("PEER_HOST") != "" {
+		host = os.Getenv("PEER_HOST")
+	} else if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if host, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	peerUrl = "http://" + net.JoinHostPort(host, port)
+	rand.Seed(time.Now().UnixNano())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blobs/", servePeerBlob)
+	go http.Serve(listener, mux)
+
+	go advertiseResources(redisPool)
+
+	log.Printf("[WORKER] serving resources to peers at %s\n", peerUrl)
+
+	return nil
+}
+
+func servePeerBlob(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	if (r.Method != "GET" && r.Method != "HEAD") || !blobstore.IsValidHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(tmpPrefix + "/resources/" + hash)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("ETag", "\""+hash+"\"")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, hash, time.Time{}, file)
+}
+
+// advertiseResources advertises all resources of this worker periodically, so that the entries of this worker
+// do not expire while it is alive.
+func advertiseResources(redisPool *redis.Pool) {
+	for {
+		conn := redisPool.Get()
+		if err := advertiseBlobs(resourceCache.hashes(), conn); err != nil {
+			log.Println(err)
+		}
+		conn.Close()
+
+		time.Sleep(pingIntervalMin * time.Minute)
+	}
+}
+
+func advertiseBlobs(hashes []string, conn redis.Conn) error {
+	if peerUrl == "" || len(hashes) == 0 {
+		return nil
+	}
+
+	now := time.Now().Unix()
+
+	conn.Send("MULTI")
+	for _, hash := range hashes {
+		conn.Send("ZADD", "blob-peers:"+hash, now, peerUrl)
+		conn.Send("EXPIRE", "blob-peers:"+hash, peerTtl)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func withdrawBlob(hash string, conn redis.Conn) error {
+	if peerUrl == "" {
+		return nil
+	}
+
+	_, err := conn.Do("ZREM", "blob-peers:"+hash, peerUrl)
+	return err
+}
+
+// findPeers returns up to peerFetchAttempts live peers holding the blob in random order.
+func findPeers(hash string, conn redis.Conn) ([]string, error) {
+	if peerUrl == "" {
+		return nil, nil
+	}
+
+	since := time.Now().Unix() - peerTtl
+
+	conn.Send("MULTI")
+	conn.Send("ZREMRANGEBYSCORE", "blob-peers:"+hash, "-inf", "("+strconv.FormatInt(since, 10))
+	conn.Send("ZRANGE", "blob-peers:"+hash, 0, -1)
+	resp, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	holders, err := redis.Strings(resp[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]string, 0, peerFetchAttempts)
+	for _, i := range rand.Perm(len(holders)) {
+		if holders[i] == peerUrl {
+			continue
+		}
+		peers = append(peers, holders[i])
+		if len(peers) == peerFetchAttempts {
+			break
+		}
+	}
+
+	return peers, nil
+}
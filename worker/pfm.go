@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"strconv"
+)
+
+// Portable Float Maps are published for float images. Rows are stored from the bottom,
+// and the pixels are little endian if the scale in the header is negative.
+
+// encodePfm writes RGB pixels of width x height given from the top row.
+func encodePfm(pix []float32, width, height int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("PF\n" + strconv.Itoa(width) + " " + strconv.Itoa(height) + "\n-1.0\n")
+	for y := height - 1; y >= 0; y-- {
+		binary.Write(&buf, binary.LittleEndian, pix[3*width*y:3*width*(y+1)])
+	}
+	return buf.Bytes()
+}
+
+// cropPfm cuts the rect out of the PFM image, keeping its channels and byte order.
+func cropPfm(data []byte, rect image.Rectangle) ([]byte, error) {
+	// magic, width, height and scale separated by whitespaces; the pixels follow a single whitespace
+	tokens := make([]string, 0, 4)
+	pos := 0
+	for len(tokens) < 4 {
+		for pos < len(data) && isPfmSpace(data[pos]) {
+			pos++
+		}
+		start := pos
+		for pos < len(data) && !isPfmSpace(data[pos]) {
+			pos++
+		}
+		if pos == len(data) {
+			return nil, errors.New("truncated pfm header")
+		}
+		tokens = append(tokens, string(data[start:pos]))
+	}
+	pos++
+
+	channels := 3
+	switch tokens[0] {
+	case "PF":
+	case "Pf":
+		channels = 1
+	default:
+		return nil, errors.New("not a pfm image")
+	}
+
+	width, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return nil, errors.New("invalid pfm size")
+	}
+	height, err := strconv.Atoi(tokens[2])
+	if err != nil {
+		return nil, errors.New("invalid pfm size")
+	}
+
+	if !rect.In(image.Rect(0, 0, width, height)) || rect.Empty() {
+		return nil, errors.New("crop window out of the pfm image")
+	}
+
+	stride := width * channels * 4
+	if len(data)-pos < stride*height {
+		return nil, errors.New("truncated pfm image")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(tokens[0] + "\n" + strconv.Itoa(rect.Dx()) + " " + strconv.Itoa(rect.Dy()) + "\n" + tokens[3] + "\n")
+	for y := rect.Max.Y - 1; y >= rect.Min.Y; y-- {
+		row := pos + stride*(height-1-y)
+		buf.Write(data[row+rect.Min.X*channels*4 : row+rect.Max.X*channels*4])
+	}
+	return buf.Bytes(), nil
+}
+
+func isPfmSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// RenderJob is a sample given to a renderer.
+type RenderJob struct {
+	RenderId   string
+	Dir        string // render directory where the resources are placed by their names
+	InputJson  string // relative to Dir
+	Seed       int
+	Tile       *Tile // render only this region; nil for the whole frame
+	FloatImage bool  // a PFM image is wanted besides the JPEG
+	Quality    int   // quality of the JPEG; 0 for defaultJpegQuality
+}
+
+// RenderOutput is the result of a renderer, which is published to render_image:<id> and render_float_image:<id>.
+type RenderOutput struct {
+	Image      []byte // JPEG, or lossless PNG for FloatImage without a float image; nil if the renderer has published render_image by itself
+	FloatImage []byte // PFM; nil if not wanted or not supported
+	Samples    int    // samples per pixel actually rendered; 0 if unknown
+	Offset     image.Point
+	Log        string
+}
+
+// Renderer runs a render job. The output is not nil even on errors, so that its Log can be reported.
+// A renderer must stop soon after the render is cancelled or timed out in running.
+type Renderer interface {
+	Render(job *RenderJob, running *RunningRender) (*RenderOutput, error)
+}
+
+// errRendererFailed is returned when the renderer rejects the job, e.g. for a broken scene; the reason is in Log.
+var errRendererFailed = errors.New("renderer failed")
+
+// errSandboxFailed is returned when the sandbox for the renderer cannot be set up; the reason is in Log.
+var errSandboxFailed = errors.New("sandbox failed")
+
+// newRendererFromEnv creates the renderer given by RENDERER: "lte" by default, "command" with RENDERER_COMMAND, or "test".
+func newRendererFromEnv(redisHost, redisPort string) (Renderer, error) {
+	switch os.Getenv("RENDERER") {
+	case "", "lte":
+		floatOutput, _ := strconv.ParseBool(os.Getenv("LTE_FLOAT_OUTPUT"))
+		return &LteRenderer{path: ltePath, redisHost: redisHost, redisPort: redisPort, floatOutput: floatOutput}, nil
+	case "command":
+		renderer, err := newCommandRenderer(os.Getenv("RENDERER_COMMAND"))
+		if err != nil {
+			return nil, err
+		}
+		return renderer, nil
+	case "test":
+		return &TestRenderer{}, nil
+	default:
+		return nil, errors.New("unknown RENDERER " + os.Getenv("RENDERER"))
+	}
+}
+
+// runRendererCommand runs the renderer process so that it is killed on cancellation or timeout, and returns its output.
+func runRendererCommand(cmd *exec.Cmd, running *RunningRender) (string, error) {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Start()
+	if err == nil {
+		running.setCmd(cmd)
+		err = cmd.Wait()
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// the renderer is not started at all, so it is not the fault of the job
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && sandbox.enabled() && status.ExitStatus() == sandboxFailureCode {
+			return output.String(), errSandboxFailed
+		}
+		return output.String(), errRendererFailed
+	}
+	return output.String(), err
+}
+
+func publishRenderOutput(renderId string, output *RenderOutput, conn redis.Conn) error {
+	if output.Image == nil && output.FloatImage == nil {
+		return nil
+	}
+
+	// the same as what LTE publishes
+	imageData, err := json.Marshal(struct {
+		JpegData string `json:"jpegdata"`
+		Samples  int    `json:"samples"`
+		X        int    `json:"x"`
+		Y        int    `json:"y"`
+	}{base64.StdEncoding.EncodeToString(output.Image), output.Samples, output.Offset.X, output.Offset.Y})
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	if output.Image != nil {
+		conn.Send("SET", "render_image:"+renderId, imageData)
+		conn.Send("EXPIRE", "render_image:"+renderId, lteAckTtl)
+	}
+	if output.FloatImage != nil {
+		conn.Send("SET", "render_float_image:"+renderId, output.FloatImage)
+		conn.Send("EXPIRE", "render_float_image:"+renderId, lteAckTtl)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+const defaultJpegQuality = 95
+
+// encodeJpeg encodes the region of the image as the JPEG published to the master.
+// quality is the one requested by the master, or 0 for defaultJpegQuality.
+func encodeJpeg(img image.Image, rect image.Rectangle, quality int) ([]byte, error) {
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+
+	if quality <= 0 {
+		quality = defaultJpegQuality
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, cropped, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodePng encodes the region of the image as a 16-bit PNG, which is published instead of the JPEG
+// when a float image is wanted but the renderer has not written it, so that the master loses no precision.
+func encodePng(img image.Image, rect image.Rectangle) ([]byte, error) {
+	cropped := image.NewNRGBA64(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, cropped); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LteRenderer runs LTE, which publishes render_image by itself through Redis.
+// Float images are written only if floatOutput is set by LTE_FLOAT_OUTPUT for the builds of LTE with lteFloatOption;
+// otherwise the master falls back to the JPEG.
+type LteRenderer struct {
+	path        string
+	redisHost   string
+	redisPort   string
+	floatOutput bool
+}
+
+func (renderer *LteRenderer) Render(job *RenderJob, running *RunningRender) (*RenderOutput, error) {
+	// the master dispatches tiles only to the renderers cropping the frame by themselves
+	if job.Tile != nil {
+		return &RenderOutput{}, errors.New("lte does not render tiles")
+	}
+
+	floatPath := job.Dir + "/framebuffer.pfm"
+	args := []string{"--session=" + job.RenderId,
+		"--resource_basepath=" + job.Dir,
+		"--redis_host=" + renderer.redisHost, "--redis_port=" + renderer.redisPort,
+		"--seed=" + strconv.Itoa(job.Seed)}
+	floatImage := job.FloatImage && renderer.floatOutput
+	if floatImage {
+		args = append(args, lteFloatOption+floatPath)
+	}
+	args = append(args, job.Dir+"/"+job.InputJson)
+
+	output := &RenderOutput{}
+	var err error
+	output.Log, err = runRendererCommand(sandbox.command(renderer.path, args, job.Dir), running)
+	if err != nil {
+		return output, err
+	}
+
+	if floatImage {
+		// the master falls back to the JPEG in render_image if this fails
+		if output.FloatImage, err = ioutil.ReadFile(floatPath); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return output, nil
+}
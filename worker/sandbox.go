@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	sandboxInitArg     = "sandbox-init" // the worker runs as the parent of the renderer in the sandbox with this argument
+	sandboxFailureCode = 125            // the sandbox-init process failed to set up the sandbox
+)
+
+// Sandbox restricts the renderer. It is configured by the environment variables of the worker.
+// SANDBOX_ROOT runs the renderer chrooted into the directory in a private mount namespace,
+// where the render directory and the resources are bind-mounted at the same paths; the directory must contain the renderer.
+// SANDBOX_UID and SANDBOX_GID run the renderer as the user and the group, which defaults to the user.
+// SANDBOX_RLIMITS limits the resources of the renderer, e.g. "as=8589934592,cpu=3600,fsize=1073741824,nofile=256".
+type Sandbox struct {
+	Root    string
+	Uid     int // -1 to keep the user of the worker
+	Gid     int
+	Rlimits []Rlimit
+}
+
+type Rlimit struct {
+	Resource int
+	Value    uint64
+}
+
+var sandbox *Sandbox
+
+func newSandboxFromEnv() (*Sandbox, error) {
+	sandbox := &Sandbox{Root: os.Getenv("SANDBOX_ROOT"), Uid: -1, Gid: -1}
+
+	if uid := os.Getenv("SANDBOX_UID"); uid != "" {
+		n, err := strconv.Atoi(uid)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid SANDBOX_UID " + uid)
+		}
+		sandbox.Uid = n
+		sandbox.Gid = n
+	}
+
+	if gid := os.Getenv("SANDBOX_GID"); gid != "" {
+		n, err := strconv.Atoi(gid)
+		if err != nil || n < 0 || sandbox.Uid < 0 {
+			return nil, errors.New("invalid SANDBOX_GID " + gid + "; SANDBOX_UID is also needed")
+		}
+		sandbox.Gid = n
+	}
+
+	if rlimits := os.Getenv("SANDBOX_RLIMITS"); rlimits != "" {
+		for _, rlimit := range strings.Split(rlimits, ",") {
+			split := strings.SplitN(rlimit, "=", 2)
+			if len(split) != 2 {
+				return nil, errors.New("invalid SANDBOX_RLIMITS " + rlimit)
+			}
+			resource, ok := rlimitResources[split[0]]
+			if !ok {
+				return nil, errors.New("unknown resource " + split[0] + " in SANDBOX_RLIMITS")
+			}
+			value, err := strconv.ParseUint(split[1], 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid SANDBOX_RLIMITS " + rlimit)
+			}
+			sandbox.Rlimits = append(sandbox.Rlimits, Rlimit{resource, value})
+		}
+	}
+
+	if sandbox.enabled() && !sandboxSupported {
+		return nil, errors.New("the sandbox is not supported on this platform")
+	}
+
+	return sandbox, nil
+}
+
+func (sandbox *Sandbox) enabled() bool {
+	return sandbox.Root != "" || sandbox.Uid >= 0 || len(sandbox.Rlimits) > 0
+}
+
+// prepare lets the renderer write its output in the render directory.
+func (sandbox *Sandbox) prepare(dir string) error {
+	if sandbox.Uid < 0 {
+		return nil
+	}
+	return os.Chown(dir, sandbox.Uid, sandbox.Gid)
+}
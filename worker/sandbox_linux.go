@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+const sandboxSupported = true
+
+var rlimitResources = map[string]int{
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+	"cpu":    syscall.RLIMIT_CPU,
+	"data":   syscall.RLIMIT_DATA,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+// command returns the command which runs the renderer in dir.
+// In the sandbox the worker itself is started with sandboxInitArg in a new mount namespace,
+// and it starts the renderer after setting up the mounts and the limits.
+func (sandbox *Sandbox) command(name string, args []string, dir string) *exec.Cmd {
+	if !sandbox.enabled() {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		return cmd
+	}
+
+	cmd := exec.Command("/proc/self/exe", append([]string{sandboxInitArg, dir, name}, args...)...)
+	cmd.Dir = dir
+	if sandbox.Root != "" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	}
+	return cmd
+}
+
+// runSandboxInit runs the renderer in the sandbox with arguments <dir> <renderer> [args...] and exits with its exit code,
+// or with sandboxFailureCode if the sandbox cannot be set up.
+func runSandboxInit(args []string) {
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "[SANDBOX] "+err.Error())
+		os.Exit(sandboxFailureCode)
+	}
+
+	if len(args) < 2 {
+		fail(fmt.Errorf("usage: worker %s <dir> <renderer> [args...]", sandboxInitArg))
+	}
+	dir, name := args[0], args[1]
+
+	sandbox, err := newSandboxFromEnv()
+	if err != nil {
+		fail(err)
+	}
+
+	if sandbox.Root != "" {
+		if err := sandbox.mount(dir); err != nil {
+			fail(err)
+		}
+	}
+
+	// inherited by the renderer
+	for _, rlimit := range sandbox.Rlimits {
+		if err := syscall.Setrlimit(rlimit.Resource, &syscall.Rlimit{Cur: rlimit.Value, Max: rlimit.Value}); err != nil {
+			fail(err)
+		}
+	}
+
+	// Pdeathsig is sent when the thread which started the renderer exits
+	runtime.LockOSThread()
+
+	cmd := exec.Command(name, args[2:]...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// the renderer is killed with this process when the render is cancelled or timed out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: sandbox.Root, Pdeathsig: syscall.SIGKILL}
+	if sandbox.Uid >= 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(sandbox.Uid), Gid: uint32(sandbox.Gid)}
+	}
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := exitErr.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+		if status.ExitStatus() == sandboxFailureCode {
+			// reserved for the failures of the sandbox
+			os.Exit(1)
+		}
+		os.Exit(status.ExitStatus())
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	os.Exit(0)
+}
+
+// mount bind-mounts the render directory and the resources in the root, which are visible only in this mount namespace.
+func (sandbox *Sandbox) mount(dir string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+
+	binds := []struct {
+		path     string
+		readOnly bool
+	}{
+		{tmpPrefix + "/resources", true},
+		{dir, false},
+	}
+
+	for _, bind := range binds {
+		target := filepath.Join(sandbox.Root, bind.path)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount(bind.path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+		if bind.readOnly {
+			if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+	"os/exec"
+)
+
+const sandboxSupported = false
+
+var rlimitResources = map[string]int{}
+
+func (sandbox *Sandbox) command(name string, args []string, dir string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+func runSandboxInit(args []string) {
+	log.Fatalln("the sandbox is not supported on this platform")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// TestRenderer draws a sphere on a checkered floor in Go, so that the whole pipeline runs without LTE.
+// It reads window_width, window_height and subsamples from the input JSON as LTE does,
+// and fails like a link error if the scenefile in the input JSON is not among the resources.
+// Every sample is jittered by the seed, so accumulated samples converge to an antialiased image.
+type TestRenderer struct{}
+
+func (renderer *TestRenderer) Render(job *RenderJob, running *RunningRender) (*RenderOutput, error) {
+	output := &RenderOutput{}
+
+	data, err := ioutil.ReadFile(job.Dir + "/" + job.InputJson)
+	if err != nil {
+		output.Log = err.Error()
+		return output, errRendererFailed
+	}
+
+	scene := struct {
+		WindowWidth  int    `json:"window_width"`
+		WindowHeight int    `json:"window_height"`
+		Subsamples   int    `json:"subsamples"`
+		SceneFile    string `json:"scenefile"`
+	}{WindowWidth: 256, WindowHeight: 256, Subsamples: 1}
+	if err := json.Unmarshal(data, &scene); err != nil {
+		output.Log = "invalid input json: " + err.Error()
+		return output, errRendererFailed
+	}
+	if scene.WindowWidth <= 0 || scene.WindowHeight <= 0 || scene.Subsamples <= 0 {
+		output.Log = "window_width, window_height and subsamples must be positive"
+		return output, errRendererFailed
+	}
+	if scene.SceneFile != "" {
+		if _, err := os.Stat(job.Dir + "/" + scene.SceneFile); err != nil {
+			output.Log = "scene file " + scene.SceneFile + " not found"
+			return output, errRendererFailed
+		}
+	}
+
+	size := image.Pt(scene.WindowWidth, scene.WindowHeight)
+	rect := image.Rectangle{Max: size}
+	if job.Tile != nil {
+		rect = job.Tile.rect(size)
+	}
+
+	random := rand.New(rand.NewSource(int64(job.Seed)))
+	img := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	pix := make([]float32, 0, 3*rect.Dx()*rect.Dy())
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		if running.isCancelled() || running.isTimedOut() {
+			return output, errors.New("test renderer interrupted")
+		}
+
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var sum [3]float64
+			for i := 0; i < scene.Subsamples; i++ {
+				// [-1, 1] in the shorter side
+				u := (2*(float64(x)+random.Float64()) - float64(size.X)) / float64(size.Y)
+				v := (float64(size.Y) - 2*(float64(y)+random.Float64())) / float64(size.Y)
+				radiance := shadeTestScene(u, v)
+				for c := range sum {
+					sum[c] += radiance[c]
+				}
+			}
+
+			var rgba [3]uint8
+			for c := range sum {
+				linear := sum[c] / float64(scene.Subsamples)
+				pix = append(pix, float32(linear))
+				rgba[c] = uint8(math.Min(math.Pow(linear, 1/2.2), 1) * 255)
+			}
+			img.SetRGBA(x-rect.Min.X, y-rect.Min.Y, color.RGBA{rgba[0], rgba[1], rgba[2], 255})
+		}
+	}
+
+	output.Samples = scene.Subsamples
+	output.Offset = rect.Min
+	if output.Image, err = encodeJpeg(img, img.Bounds(), job.Quality); err != nil {
+		return output, err
+	}
+	if job.FloatImage {
+		output.FloatImage = encodePfm(pix, rect.Dx(), rect.Dy())
+	}
+	output.Log = "test renderer: " + strconv.Itoa(rect.Dx()) + "x" + strconv.Itoa(rect.Dy()) + " pixels, " +
+		strconv.Itoa(scene.Subsamples) + " samples\n"
+
+	return output, nil
+}
+
+// shadeTestScene returns the linear radiance seen through (u, v) on the screen.
+func shadeTestScene(u, v float64) [3]float64 {
+	// a pinhole camera at the origin looking at -z
+	dir := normalize([3]float64{u, v, -2})
+	light := normalize([3]float64{1, 2, 1})
+
+	// the unit sphere at (0, 0, -4)
+	center := [3]float64{0, 0, -4}
+	b := dot(dir, center)
+	if d := b*b - dot(center, center) + 1; d > 0 {
+		t := b - math.Sqrt(d)
+		normal := [3]float64{dir[0]*t - center[0], dir[1]*t - center[1], dir[2]*t - center[2]}
+		diffuse := 0.05 + 0.8*math.Max(dot(normal, light), 0)
+		return [3]float64{0.8 * diffuse, 0.3 * diffuse, 0.2 * diffuse}
+	}
+
+	// the floor at y = -1
+	if dir[1] < 0 {
+		t := -1 / dir[1]
+		x, z := dir[0]*t, dir[2]*t
+		albedo := 0.2
+		if (int(math.Floor(x))+int(math.Floor(z)))%2 == 0 {
+			albedo = 0.7
+		}
+		return [3]float64{albedo, albedo, albedo}
+	}
+
+	// the sky
+	return [3]float64{0.4 + 0.4*dir[1], 0.6 + 0.3*dir[1], 1}
+}
+
+func dot(a, b [3]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func normalize(a [3]float64) [3]float64 {
+	l := math.Sqrt(dot(a, a))
+	return [3]float64{a[0] / l, a[1] / l, a[2] / l}
+}
@@ -1,33 +1,48 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"github.com/lighttransport/francine/blobstore"
+	"github.com/lighttransport/francine/protocol"
+	"image"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	ltePath         = "/bin/lte"
+	lteFloatOption  = "--float_output=" // writes a PFM framebuffer to the given path; not in every build of LTE, so used only with LTE_FLOAT_OUTPUT
 	redisMaxIdle    = 5
 	lteAckTtl       = 3600 // one hour
 	pingIntervalMin = 1    // minutes
 	verbose         = false
 	tmpPrefix       = "/tmp/lte"
 	cleanupInterval = 10 // minutes
+	pollTimeout     = 5  // seconds
+	fetchAttempts   = 3
+
+	resourceDeletingTtl = 60 // seconds to wait for the blob of a released resource to be deleted
+
+	maxResourceNameLength = 1024
 )
 
 // TODO: DRY
 func releaseResource(hash string, conn redis.Conn) error {
-	if _, err := conn.Do("WATCH", "resource:"+hash, "resource:"+hash+":counter"); err != nil {
+	if _, err := conn.Do("WATCH", "resource:"+hash+":counter"); err != nil {
 		return err
 	}
 	counterBytes, err := conn.Do("GET", "resource:"+hash+":counter")
@@ -44,7 +59,9 @@ func releaseResource(hash string, conn redis.Conn) error {
 	if counter > 1 {
 		conn.Send("SET", "resource:"+hash+":counter", counter-1)
 	} else {
-		conn.Send("DEL", "resource:"+hash, "resource:"+hash+":counter")
+		// new references wait in watchResource until the blob is deleted
+		conn.Send("DEL", "resource:"+hash+":counter")
+		conn.Send("SET", "resource:"+hash+":deleting", 1, "EX", resourceDeletingTtl)
 	}
 
 	resp, err := conn.Do("EXEC")
@@ -55,6 +72,21 @@ func releaseResource(hash string, conn redis.Conn) error {
 		return errors.New("optimistic locking failed")
 	}
 
+	// the blob is not referred any more once the counter is deleted
+	if counter <= 1 {
+		// the counter is checked again in case the deleting mark has expired meanwhile
+		if referred, err := redis.Bool(conn.Do("EXISTS", "resource:"+hash+":counter")); err != nil {
+			log.Printf("[WORKER] failed to delete blob %s: %s\n", hash, err.Error())
+		} else if !referred {
+			if err := blobStore.Delete(hash); err != nil {
+				log.Printf("[WORKER] failed to delete blob %s: %s\n", hash, err.Error())
+			}
+		}
+		if _, err := conn.Do("DEL", "resource:"+hash+":deleting"); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -63,11 +95,63 @@ type Resource struct {
 	Hash string
 }
 
+// isValidResourceName reports whether the name is a clean relative path without "..",
+// so that the resource cannot be placed out of the render directory.
+// TODO: DRY; the same as master/rest.go
+func isValidResourceName(name string) bool {
+	if name == "" || name == "." || len(name) > maxResourceNameLength || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return false
+		}
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || c == '\\' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Tile is the region X, Y of the frame split into Cols x Rows.
+type Tile struct {
+	X    int
+	Y    int
+	Cols int
+	Rows int
+}
+
+// cropWindow returns the tile as a normalized crop window.
+func (tile *Tile) cropWindow() string {
+	format := func(n, d int) string {
+		return strconv.FormatFloat(float64(n)/float64(d), 'f', -1, 64)
+	}
+	return format(tile.X, tile.Cols) + "," + format(tile.Y, tile.Rows) + "," +
+		format(tile.X+1, tile.Cols) + "," + format(tile.Y+1, tile.Rows)
+}
+
+// rect returns the pixels of the tile in the frame of the size.
+func (tile *Tile) rect(size image.Point) image.Rectangle {
+	return image.Rect(tile.X*size.X/tile.Cols, tile.Y*size.Y/tile.Rows,
+		(tile.X+1)*size.X/tile.Cols, (tile.Y+1)*size.Y/tile.Rows)
+}
+
 type Message struct {
-	RenderId  string
-	SessionId string
-	InputJson string
-	Resources []Resource
+	RenderId    string
+	SessionId   string
+	InputJson   string
+	Resources   []Resource
+	Attempt     int
+	MaxAttempts int
+	Timeout     int   // seconds
+	FloatImage  bool  // publish a PFM image to render_float_image:<id> besides the JPEG
+	Quality     int   `json:",omitempty"` // quality of the JPEG; 0 for the default of the worker
+	Tile        *Tile `json:",omitempty"` // render only this region; nil for the whole frame
 }
 
 type LteAck struct {
@@ -76,7 +160,283 @@ type LteAck struct {
 	Log      string
 }
 
-func kickRenderer(msgBytes []byte, conn redis.Conn, redisHost string, redisPort string) {
+// releaseHashes releases the resources of the hashes for protocol.RequeueInflightRenders.
+func releaseHashes(conn redis.Conn) func(hashes []string) {
+	return func(hashes []string) {
+		resources := make([]Resource, 0, len(hashes))
+		for _, hash := range hashes {
+			resources = append(resources, Resource{Hash: hash})
+		}
+		releaseResources(resources, conn)
+	}
+}
+
+func releaseResources(resources []Resource, conn redis.Conn) {
+	for _, resource := range resources {
+		success := false
+		for i := 0; i < 5; i++ {
+			err := releaseResource(resource.Hash, conn)
+			if err == nil {
+				success = true
+				break
+			}
+			log.Printf("[WORKER] retry deleting resource %s\n", resource.Hash)
+			time.Sleep(200 * time.Microsecond)
+		}
+		if !success {
+			log.Printf("[WORKER] failed to release resource %s\n", resource.Hash)
+		}
+	}
+}
+
+// blobStore is set on startup from BLOB_STORE.
+var blobStore blobstore.BlobStore
+
+// masterUrl is set from MASTER_URL. If it is set, resources are fetched from the master over HTTP instead of the blob store.
+var masterUrl string
+
+// downloadResource writes the blob of the hash to path after verifying its hash.
+// It is fetched from a peer if any holds it, or else from the master if MASTER_URL is set, or from the blob store.
+func downloadResource(hash, path string, conn redis.Conn) error {
+	peers, err := findPeers(hash, conn)
+	if err != nil {
+		log.Println(err)
+	}
+
+	downloaded := false
+	for _, peer := range peers {
+		blobUrl := peer + "/blobs/" + hash
+		err := downloadBlob(hash, path, func(w io.Writer) error {
+			return fetchBlob(blobUrl, hash, w)
+		})
+		if err == nil {
+			downloaded = true
+			break
+		}
+		log.Printf("[WORKER] failed to fetch resource %s from peer %s: %s\n", hash, peer, err.Error())
+	}
+
+	if !downloaded {
+		err := downloadBlob(hash, path, func(w io.Writer) error {
+			if masterUrl != "" {
+				return fetchBlob(masterUrl+"/v0/blobs/"+hash, hash, w)
+			}
+			return copyBlob(hash, w)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := advertiseBlobs([]string{hash}, conn); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// downloadBlob writes the blob by fetch to a temporary file and renames it to path if the hash matches,
+// so that cleanResources, renders and peers never see a partial or broken file.
+func downloadBlob(hash, path string, fetch func(io.Writer) error) error {
+	if err := os.MkdirAll(tmpPrefix+"/downloads", 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(tmpPrefix+"/downloads", hash)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	err = fetch(io.MultiWriter(file, hasher))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hasher.Sum(nil)) != hash {
+		err = errors.New("hash of resource " + hash + " does not match")
+	}
+	if err == nil {
+		// readable by the renderer running as another user in the sandbox
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func copyBlob(hash string, w io.Writer) error {
+	reader, _, err := blobStore.Open(hash)
+	if err == blobstore.ErrBlobNotFound {
+		return errors.New("cannot obtain resource " + hash)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// fetchBlob downloads the blob from the master or a peer. An interrupted download is resumed by a range request.
+func fetchBlob(blobUrl, hash string, w io.Writer) error {
+	written := int64(0)
+	for i := 0; i < fetchAttempts; i++ {
+		if i > 0 {
+			log.Printf("[WORKER] retry fetching blob %s from %d bytes\n", hash, written)
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+
+		req, err := http.NewRequest("GET", blobUrl, nil)
+		if err != nil {
+			return err
+		}
+		if written > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(written, 10)+"-")
+			req.Header.Set("If-Range", "\""+hash+"\"")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			resp.Body.Close()
+			return errors.New("cannot obtain resource " + hash)
+		case resp.StatusCode == http.StatusOK && written == 0, resp.StatusCode == http.StatusPartialContent && written > 0:
+		default:
+			resp.Body.Close()
+			log.Printf("[WORKER] unexpected response %s for blob %s\n", resp.Status, hash)
+			continue
+		}
+
+		n, err := io.Copy(w, resp.Body)
+		resp.Body.Close()
+		written += n
+		if err == nil {
+			return nil
+		}
+		log.Println(err)
+	}
+
+	return errors.New("failed to fetch resource " + hash)
+}
+
+// RunningRender is the render which the worker is running now.
+// It is shared with watchCancels so that the renderer process can be killed on cancellation or timeout.
+type RunningRender struct {
+	mutex     sync.Mutex
+	renderId  string
+	cmd       *exec.Cmd
+	cancelled bool
+	timedOut  bool
+}
+
+func (running *RunningRender) begin(renderId string) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	running.renderId = renderId
+	running.cmd = nil
+	running.cancelled = false
+	running.timedOut = false
+}
+
+func (running *RunningRender) end() {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	running.renderId = ""
+	running.cmd = nil
+}
+
+// setCmd registers the started renderer process, and kills it if the render is already cancelled or timed out.
+func (running *RunningRender) setCmd(cmd *exec.Cmd) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	running.cmd = cmd
+	if running.cancelled || running.timedOut {
+		cmd.Process.Kill()
+	}
+}
+
+func (running *RunningRender) cancel(renderId string) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	if running.renderId != renderId || running.cancelled {
+		return
+	}
+
+	log.Printf("[WORKER] cancelling render %s\n", renderId)
+
+	running.cancelled = true
+	if running.cmd != nil {
+		running.cmd.Process.Kill()
+	}
+}
+
+func (running *RunningRender) expire(renderId string) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	if running.renderId != renderId || running.cancelled || running.timedOut {
+		return
+	}
+
+	log.Printf("[WORKER] render %s timed out\n", renderId)
+
+	running.timedOut = true
+	if running.cmd != nil {
+		running.cmd.Process.Kill()
+	}
+}
+
+func (running *RunningRender) isCancelled() bool {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	return running.cancelled
+}
+
+func (running *RunningRender) isTimedOut() bool {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+
+	return running.timedOut
+}
+
+func watchCancels(redisPool *redis.Pool, running *RunningRender) {
+	for {
+		conn := redisPool.Get()
+		psc := redis.PubSubConn{Conn: conn}
+		if err := psc.Subscribe("render-cancel"); err != nil {
+			log.Println(err)
+		} else {
+		receive:
+			for {
+				switch v := psc.Receive().(type) {
+				case redis.Message:
+					running.cancel(string(v.Data))
+				case error:
+					log.Println(v)
+					break receive
+				}
+			}
+		}
+		conn.Close()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func kickRenderer(msgBytes []byte, conn redis.Conn, renderer Renderer, running *RunningRender, inflightName string) {
 	timeBeforeConn := time.Now()
 
 	var message Message
@@ -85,74 +445,102 @@ func kickRenderer(msgBytes []byte, conn redis.Conn, redisHost string, redisPort
 
 	json.Unmarshal(msgBytes, &message)
 
+	running.begin(message.RenderId)
+	defer running.end()
+
+	// references taken by the master on dispatch are kept until the message leaves the in-flight list,
+	// so that the resources survive when the message is requeued. They are released only if this worker
+	// removed the message; if it has already been requeued, the references go with the requeued one.
+	defer func() {
+		removed, err := redis.Int(conn.Do("LREM", inflightName, 1, msgBytes))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if removed == 1 {
+			releaseResources(message.Resources, conn)
+		}
+	}()
+
+	fail := func(err error) {
+		log.Println(err)
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Failed", Log: err.Error()}, conn)
+	}
+
+	if cancelled, err := conn.Do("EXISTS", "render_cancelled:"+message.RenderId); err != nil {
+		log.Println(err)
+	} else if cancelled.(int64) == 1 {
+		log.Printf("[WORKER] render %s was cancelled before start\n", message.RenderId)
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Cancelled"}, conn)
+		return
+	}
+
 	sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Start"}, conn)
 
+	if message.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(message.Timeout)*time.Second, func() {
+			running.expire(message.RenderId)
+		})
+		defer timer.Stop()
+	}
+
 	resourceDir := tmpPrefix + "/renders/" + message.RenderId
+	var pinned []string
 
 	if err := os.MkdirAll(resourceDir, 0755); err != nil {
-		log.Println(err)
+		fail(err)
 		return
 	}
 
-	if err := os.MkdirAll(tmpPrefix+"/resources", 0755); err != nil {
-		log.Println(err)
+	if err := os.Chdir(resourceDir); err != nil {
+		fail(err)
 		return
 	}
 
-	if err := os.Chdir(resourceDir); err != nil {
-		log.Println(err)
+	if err := sandbox.prepare(resourceDir); err != nil {
+		fail(err)
 		return
 	}
 
-	// write the resource files
+	// the master validates names too, but the messages in the queue are not trusted
+	if !isValidResourceName(message.InputJson) {
+		fail(errors.New("invalid input json name " + message.InputJson))
+		return
+	}
 	for _, resource := range message.Resources {
-		realPath := tmpPrefix + "/resources/" + resource.Hash
-		if _, err := os.Stat(realPath); os.IsNotExist(err) {
-			data, err := conn.Do("GET", "resource:"+resource.Hash)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			file, err := os.Create(realPath)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			if data == nil {
-				log.Printf("[WORKER] cannot obtain resource %s\n", resource.Hash)
-				return
-			}
-
-			file.Write(data.([]byte))
-			file.Close()
+		if !isValidResourceName(resource.Name) {
+			fail(errors.New("invalid resource name " + resource.Name))
+			return
+		}
+	}
 
-			success := false
-			for i := 0; i < 5; i++ {
-				err = releaseResource(resource.Hash, conn)
-				if err == nil {
-					success = true
-					break
-				}
-				log.Printf("[WORKER] retry deleting resource %s\n", resource.Hash)
-				time.Sleep(200 * time.Microsecond)
-			}
-			if !success {
-				log.Printf("[WORKER] failed to release resource %s\n", resource.Hash)
-			}
+	// the resources are pinned in the cache while they are symlinked from resourceDir
+	defer func() {
+		for _, hash := range pinned {
+			resourceCache.release(hash)
+		}
+		evictResources(conn)
+	}()
 
+	// write the resource files
+	for _, resource := range message.Resources {
+		realPath, err := resourceCache.acquire(resource.Hash, func(path string) error {
+			return downloadResource(resource.Hash, path, conn)
+		})
+		if err != nil {
+			fail(err)
+			return
 		}
+		pinned = append(pinned, resource.Hash)
 
-		// TODO: it has obvious security problem! be aware!
 		symPath := resourceDir + "/" + resource.Name
 		if err := os.MkdirAll(filepath.Dir(symPath), 0755); err != nil {
-			log.Println(err)
+			fail(err)
 			return
 		}
 
 		if err := os.Symlink(realPath, symPath); err != nil {
-			log.Println(err)
+			fail(err)
 			return
 		}
 	}
@@ -181,33 +569,38 @@ func kickRenderer(msgBytes []byte, conn redis.Conn, redisHost string, redisPort
 		}
 	*/
 	parsed, _ := strconv.ParseInt(message.RenderId, 10, 64)
-	seed := strconv.Itoa(int(parsed & (1<<30 - 1)))
-	rendererCmd := exec.Command(ltePath, "--session="+message.RenderId,
-		"--resource_basepath="+resourceDir,
-		"--redis_host="+redisHost, "--redis_port="+redisPort,
-		"--seed="+seed,
-		resourceDir+"/"+message.InputJson)
-	var rendererOutput bytes.Buffer
-	rendererCmd.Stdout = &rendererOutput
-	rendererCmd.Stderr = &rendererOutput
-
-	rendererErr := rendererCmd.Run()
+	job := &RenderJob{
+		RenderId:   message.RenderId,
+		Dir:        resourceDir,
+		InputJson:  message.InputJson,
+		Seed:       int(parsed & (1<<30 - 1)),
+		Tile:       message.Tile,
+		FloatImage: message.FloatImage,
+		Quality:    message.Quality}
+	output, rendererErr := renderer.Render(job, running)
 
 	if verbose {
-		log.Println("[WORKER] lte: " + rendererOutput.String())
-	}
-
-	if rendererErr != nil {
-		if _, ok := rendererErr.(*exec.ExitError); ok {
-			sendLteAck(&LteAck{RenderId: message.RenderId, Status: "LinkError", Log: rendererOutput.String()}, conn)
-		} else {
-			log.Println(rendererErr)
-		}
+		log.Println("[WORKER] renderer: " + output.Log)
 	}
 
 	timeAfterEverything := time.Now()
 
-	sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Ok"}, conn)
+	if running.isCancelled() {
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Cancelled"}, conn)
+	} else if running.isTimedOut() {
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Timeout",
+			Log: "renderer killed after " + strconv.Itoa(message.Timeout) + " seconds\n" + output.Log}, conn)
+	} else if rendererErr == errRendererFailed {
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "LinkError", Log: output.Log}, conn)
+	} else if rendererErr != nil {
+		log.Println(rendererErr)
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Failed", Log: rendererErr.Error() + "\n" + output.Log}, conn)
+	} else if err := publishRenderOutput(message.RenderId, output, conn); err != nil {
+		log.Println(err)
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Failed", Log: err.Error() + "\n" + output.Log}, conn)
+	} else {
+		sendLteAck(&LteAck{RenderId: message.RenderId, Status: "Ok"}, conn)
+	}
 
 	if err := os.RemoveAll(resourceDir); err != nil {
 		log.Println(err)
@@ -236,16 +629,30 @@ func sendLteAck(data *LteAck, conn redis.Conn) {
 	}
 }
 
+// sendPings pushes "ping:<worker name>:<cache stats in JSON>" to the master.
 func sendPings(workerName string, redisPool *redis.Pool) {
 	conn := redisPool.Get()
 	defer conn.Close()
 
 	for {
-		conn.Do("RPUSH", "cmd:lte-master", "ping:"+workerName)
+		stats, _ := json.Marshal(resourceCache.getStats())
+		conn.Do("RPUSH", "cmd:lte-master", "ping:"+workerName+":"+string(stats))
 		time.Sleep(pingIntervalMin * time.Minute)
 	}
 }
 
+// evictResources shrinks the resource cache to its limit and stops advertising the evicted resources to peers.
+func evictResources(conn redis.Conn) {
+	for _, hash := range resourceCache.evict() {
+		if verbose {
+			log.Printf("[WORKER] evicted resource %s\n", hash)
+		}
+		if err := withdrawBlob(hash, conn); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func cleanResources(redisPool *redis.Pool) {
 	conn := redisPool.Get()
 	defer conn.Close()
@@ -253,21 +660,12 @@ func cleanResources(redisPool *redis.Pool) {
 		time.Sleep(cleanupInterval * time.Minute)
 		log.Println("[WORKER] clean up unused resources ...")
 
-		if err := os.MkdirAll(tmpPrefix+"/resources", 0755); err != nil {
-			log.Println(err)
-			return
-		}
-
-		// list up files in resource directory
-		files, err := ioutil.ReadDir(tmpPrefix + "/resources")
-		if err != nil {
-			log.Println(err)
-			return
-		}
+		hashes := resourceCache.hashes()
 
 		conn.Send("MULTI")
-		for _, file := range files {
-			conn.Send("EXISTS", "resource:"+file.Name())
+		for _, hash := range hashes {
+			// a blob is kept while its counter exists, wherever it is stored
+			conn.Send("EXISTS", "resource:"+hash+":counter")
 		}
 
 		exists, err := conn.Do("EXEC")
@@ -281,16 +679,24 @@ func cleanResources(redisPool *redis.Pool) {
 			if existBool {
 				continue
 			}
-			err = os.Remove(tmpPrefix + "/resources/" + files[i].Name())
-			if err != nil {
+			// resources used by the running render are removed in the next cleanup
+			if !resourceCache.remove(hashes[i]) {
+				continue
+			}
+			if err := withdrawBlob(hashes[i], conn); err != nil {
 				log.Println(err)
-				return
 			}
 		}
+
+		evictResources(conn)
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		runSandboxInit(os.Args[2:])
+	}
+
 	workerName := os.Getenv("WORKER_NAME")
 	if workerName == "" {
 		log.Fatalln("please set WORKER_NAME")
@@ -311,43 +717,101 @@ func main() {
 		}, redisMaxIdle)
 	defer redisPool.Close()
 
+	var err error
+	blobStore, err = blobstore.New(os.Getenv("BLOB_STORE"), redisPool)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	masterUrl = strings.TrimSuffix(os.Getenv("MASTER_URL"), "/")
+
+	sandbox, err = newSandboxFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	renderer, err := newRendererFromEnv(redisHost, redisPort)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	cacheSize := int64(0)
+	if os.Getenv("CACHE_SIZE") != "" {
+		if cacheSize, err = strconv.ParseInt(os.Getenv("CACHE_SIZE"), 10, 64); err != nil {
+			log.Fatalln("invalid CACHE_SIZE")
+		}
+	}
+	resourceCache, err = newResourceCache(tmpPrefix+"/resources", cacheSize)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	{
+		redisConn := redisPool.Get()
+		evictResources(redisConn)
+		redisConn.Close()
+	}
+
+	if peerAddr := os.Getenv("PEER_ADDR"); peerAddr != "" {
+		if err := startPeerServer(peerAddr, redisPool); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	go sendPings(workerName, redisPool)
 
 	cmdQueueName := "cmd:" + workerName
+	inflightName := "render-inflight:" + workerName
+
+	{
+		redisConn := redisPool.Get()
+		// let the master find our in-flight list when we die
+		if _, err := redisConn.Do("SADD", "render-inflight-workers", workerName); err != nil {
+			log.Fatalln(err)
+		}
+		// renders left by the previous run of this worker
+		if err := protocol.RequeueInflightRenders(inflightName, redisConn, "[WORKER]", releaseHashes(redisConn)); err != nil {
+			log.Fatalln(err)
+		}
+		redisConn.Close()
+	}
 
 	go cleanResources(redisPool)
 
+	running := &RunningRender{}
+	go watchCancels(redisPool, running)
+
 	for {
 		redisConn := redisPool.Get()
 
-		resp, err := redisConn.Do("BLPOP", "render-queue", cmdQueueName, 0)
+		// render-queue is pushed from the left, so popping from the right keeps it FIFO
+		resp, err := redisConn.Do("BRPOPLPUSH", "render-queue", inflightName, pollTimeout)
+		if err != nil {
+			redisConn.Close()
+			log.Fatalln(err)
+		}
 
 		if resp != nil {
-			listName := string(resp.([]interface{})[0].([]byte))
-			popped := resp.([]interface{})[1].([]byte)
-
-			switch listName {
-			case "render-queue":
-				kickRenderer(popped, redisConn, redisHost, redisPort)
-			case cmdQueueName:
-				switch string(popped) {
-				case "stop":
-					redisConn.Close()
-					log.Printf("[WORKER] stopping worker %s ...\n", workerName)
-					os.Exit(0)
-				case "restart":
-					redisConn.Close()
-					log.Printf("[WORKER] restarting worker %s ...\n", workerName)
-					os.Exit(1)
-				}
-			}
+			kickRenderer(resp.([]byte), redisConn, renderer, running, inflightName)
 		}
 
+		cmd, err := redisConn.Do("LPOP", cmdQueueName)
 		if err != nil {
 			redisConn.Close()
 			log.Fatalln(err)
 		}
 
+		if cmd != nil {
+			switch string(cmd.([]byte)) {
+			case "stop":
+				redisConn.Close()
+				log.Printf("[WORKER] stopping worker %s ...\n", workerName)
+				os.Exit(0)
+			case "restart":
+				redisConn.Close()
+				log.Printf("[WORKER] restarting worker %s ...\n", workerName)
+				os.Exit(1)
+			}
+		}
+
 		redisConn.Close()
 	}
 }